@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/utkarshgupta2804/p2p-filestorage/p2p"
+)
+
+// MessageChunkRequest answers a MessageStoreFile stream header with the
+// chunks the receiver doesn't hold yet
+type MessageChunkRequest struct {
+	Missing []int // Indexes into the offered manifest
+}
+
+// blob is a file in the form it is stored on peers: a manifest of encrypted
+// chunks and a source for each chunk
+type blob struct {
+	manifest *Manifest
+	chunk    func(i int) ([]byte, error)
+}
+
+// originBlob returns the network form of a file this node stored. Each chunk
+// is encrypted with its own key, and the chunk keys travel with the manifest
+// sealed under the file's data key. Chunks are encrypted again when read
+// rather than kept around, so memory use doesn't grow with the file size.
+func (s *FileServer) originBlob(key string) (*blob, error) {
+	local, err := s.store.ReadManifest(s.ID, key)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := s.Keyring.CreateDataKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]byte, 0, len(local.Chunks)*keySize)
+	for _, c := range local.Chunks {
+		keys = append(keys, s.Keyring.chunkKey(key, c.Hash)...)
+	}
+	sealed := new(bytes.Buffer)
+	if _, err := copyEncrypt(context.Background(), dataKey, bytes.NewReader(keys), sealed); err != nil {
+		return nil, err
+	}
+
+	encrypt := func(i int) ([]byte, error) {
+		b, err := s.store.ReadChunk(local.Chunks[i].Hash)
+		if err != nil {
+			return nil, err
+		}
+		return encryptChunk(keys[i*keySize:(i+1)*keySize], b)
+	}
+
+	m := &Manifest{Chunks: make([]ChunkRef, len(local.Chunks)), Keys: sealed.Bytes(), Created: local.Created, Epoch: s.Keyring.keyEpoch(key)}
+	for i := range local.Chunks {
+		b, err := encrypt(i)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(b)
+		m.Chunks[i] = ChunkRef{Hash: hex.EncodeToString(sum[:]), Size: int64(len(b))}
+		m.Size += int64(len(b))
+	}
+
+	return &blob{manifest: m, chunk: encrypt}, nil
+}
+
+// replicaBlob returns a file held for another node, it is already encrypted
+func (s *FileServer) replicaBlob(id string, key string) (*blob, error) {
+	m, err := s.store.ReadManifest(id, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &blob{
+		manifest: m,
+		chunk: func(i int) ([]byte, error) {
+			return s.store.ReadChunk(m.Chunks[i].Hash)
+		},
+	}, nil
+}
+
+// writeChunks writes the chunks with the given indexes back to back
+func (b *blob) writeChunks(w io.Writer, indexes []int) (int64, error) {
+	var n int64
+	for _, i := range indexes {
+		if i < 0 || i >= len(b.manifest.Chunks) {
+			return n, fmt.Errorf("chunk index %d out of range", i)
+		}
+		data, err := b.chunk(i)
+		if err != nil {
+			return n, err
+		}
+		nn, err := w.Write(data)
+		n += int64(nn)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// pushFile offers a file to peer, sends the chunks it is missing and waits
+// until the peer has written the file to disk. It returns the bytes sent.
+func (s *FileServer) pushFile(ctx context.Context, peer p2p.Peer, id string, key string, b *blob) (int64, error) {
+	header, err := encodeMessage(s.message(MessageStoreFile{
+		ID:       id,
+		Key:      key,
+		Manifest: *b.manifest,
+	}))
+	if err != nil {
+		return 0, err
+	}
+
+	stream, err := peer.OpenStream(header)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Reset()
+	defer resetOnDone(ctx, stream)()
+
+	var msg Message
+	if err := gob.NewDecoder(stream).Decode(&msg); err != nil {
+		return 0, err
+	}
+	var req MessageChunkRequest
+	switch v := msg.Payload.(type) {
+	case MessageChunkRequest:
+		req = v
+	case MessageDeleteFile:
+		// The file was deleted while we weren't listening
+		if err := s.applyDelete(v); err != nil {
+			return 0, err
+		}
+		return 0, ErrDeleted
+	default:
+		return 0, fmt.Errorf("unexpected reply %T to store offer", msg.Payload)
+	}
+
+	n, err := b.writeChunks(stream, req.Missing)
+	if err != nil {
+		return n, err
+	}
+
+	// The peer closes its side once the file is on disk
+	stream.Close()
+	_, err = io.Copy(io.Discard, stream)
+	return n, err
+}
+
+// chunkDecrypter reads the chunks of an encrypted manifest from r, checking
+// each against its hash, and returns the decrypted file
+type chunkDecrypter struct {
+	keys   []byte // Keys of the chunks not read yet
+	r      io.Reader
+	chunks []ChunkRef // Chunks not read yet
+	buf    bytes.Reader
+}
+
+// newChunkDecrypter unseals the chunk keys of the network form of a file
+// stored under key and decrypts its chunks from r
+func (s *FileServer) newChunkDecrypter(key string, m *Manifest, r io.Reader) (*chunkDecrypter, error) {
+	dataKey, err := s.Keyring.DataKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := new(bytes.Buffer)
+	_, err = copyDecrypt(context.Background(), dataKey, bytes.NewReader(m.Keys), keys)
+	if errors.Is(err, ErrAuthentication) {
+		return nil, fmt.Errorf("sealed chunk keys: %w", ErrCorrupted)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if keys.Len() != len(m.Chunks)*keySize {
+		return nil, fmt.Errorf("have %d chunk keys for %d chunks", keys.Len()/keySize, len(m.Chunks))
+	}
+
+	return &chunkDecrypter{keys: keys.Bytes(), r: r, chunks: m.Chunks}, nil
+}
+
+func (d *chunkDecrypter) Read(b []byte) (int, error) {
+	for d.buf.Len() == 0 {
+		if len(d.chunks) == 0 {
+			return 0, io.EOF
+		}
+		c, key := d.chunks[0], d.keys[:keySize]
+		d.chunks, d.keys = d.chunks[1:], d.keys[keySize:]
+
+		if c.Size < 0 || c.Size > maxChunkSize+chunkOverhead {
+			return 0, fmt.Errorf("chunk %s has invalid size %d", c.Hash, c.Size)
+		}
+		data := make([]byte, c.Size)
+		if _, err := io.ReadFull(d.r, data); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != c.Hash {
+			return 0, &CorruptedError{Hash: c.Hash}
+		}
+
+		plain, err := decryptChunk(key, data)
+		if errors.Is(err, ErrAuthentication) {
+			return 0, &CorruptedError{Hash: c.Hash}
+		}
+		if err != nil {
+			return 0, err
+		}
+		d.buf.Reset(plain)
+	}
+	return d.buf.Read(b)
+}
+
+func init() {
+	gob.Register(MessageChunkRequest{})
+}
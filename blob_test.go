@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestChunkDecrypterVerifies(t *testing.T) {
+	s := NewFileServer(FileServerOpts{
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Transport:         stubTransport{},
+	})
+	data := []byte("my big data file here!")
+	if err := s.Store("file", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.originBlob("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wire := new(bytes.Buffer)
+	if _, err := b.writeChunks(wire, []int{0}); err != nil {
+		t.Fatal(err)
+	}
+
+	dec, err := s.newChunkDecrypter("file", b.manifest, bytes.NewReader(wire.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, err := ioutil.ReadAll(dec); err != nil || !bytes.Equal(have, data) {
+		t.Fatalf("have %q, %v want %q", have, err, data)
+	}
+
+	// A peer handing out modified or truncated chunks is caught
+	tampered := append([]byte(nil), wire.Bytes()...)
+	tampered[len(tampered)-1] ^= 1
+	for name, tt := range map[string]struct {
+		data []byte
+		err  error
+	}{
+		"tampered":  {tampered, ErrCorrupted},
+		"truncated": {wire.Bytes()[:wire.Len()-1], io.ErrUnexpectedEOF},
+	} {
+		dec, _ := s.newChunkDecrypter("file", b.manifest, bytes.NewReader(tt.data))
+		if _, err := ioutil.ReadAll(dec); !errors.Is(err, tt.err) {
+			t.Errorf("%s: have %v want %v", name, err, tt.err)
+		}
+	}
+}
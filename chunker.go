@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+)
+
+const (
+	minChunkSize = 16 << 10  // No cut point is looked for before this many bytes
+	avgChunkSize = 64 << 10  // Chunk size the cut masks aim for
+	maxChunkSize = 256 << 10 // Chunks are cut here at the latest
+)
+
+// Cut masks for normalized chunking, testing the high bits of the gear hash
+// since those depend on the most input bytes. The stricter mask is used
+// below the average size and the looser one above, pulling chunk sizes
+// towards the average.
+const (
+	maskSmall uint64 = (1<<18 - 1) << (64 - 18)
+	maskLarge uint64 = (1<<14 - 1) << (64 - 14)
+)
+
+// gearTable maps bytes to random values for the rolling hash. It must never
+// change, otherwise the same content is cut differently and stops deduplicating.
+var gearTable [256]uint64
+
+func init() {
+	// splitmix64 with a fixed seed
+	seed := uint64(0x6a09e667f3bcc908)
+	for i := range gearTable {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+// cutPoint returns the length of the chunk starting at data[0], using
+// FastCDC's gear hash
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= minChunkSize {
+		return n
+	}
+	if n > maxChunkSize {
+		n = maxChunkSize
+	}
+	normal := avgChunkSize
+	if n < normal {
+		normal = n
+	}
+
+	var h uint64
+	i := minChunkSize
+	for ; i < normal; i++ {
+		h = (h << 1) + gearTable[data[i]]
+		if h&maskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = (h << 1) + gearTable[data[i]]
+		if h&maskLarge == 0 {
+			return i + 1
+		}
+	}
+
+	return n
+}
+
+// chunker splits a stream into content-defined chunks, so an edit only
+// changes the chunks around it. Memory use is bounded by maxChunkSize.
+type chunker struct {
+	r     io.Reader
+	buf   []byte
+	start int  // Start of unread data in buf
+	end   int  // End of unread data in buf
+	eof   bool // r is exhausted
+}
+
+// newChunker creates a chunker reading from r
+func newChunker(r io.Reader) *chunker {
+	return &chunker{
+		r:   r,
+		buf: make([]byte, maxChunkSize),
+	}
+}
+
+// Next returns the next chunk, or io.EOF once r is exhausted. The chunk is
+// only valid until the following call.
+func (c *chunker) Next() ([]byte, error) {
+	// Move leftovers to the front and fill up to a full max size chunk
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+	for !c.eof && c.end < len(c.buf) {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.end == 0 {
+		return nil, io.EOF
+	}
+
+	c.start = cutPoint(c.buf[:c.end])
+	return c.buf[:c.start], nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func chunkAll(t *testing.T, data []byte) [][]byte {
+	chunks := [][]byte{}
+	c := newChunker(bytes.NewReader(data))
+	for {
+		b, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, append([]byte(nil), b...))
+	}
+}
+
+func TestChunkerBounds(t *testing.T) {
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := chunkAll(t, data)
+	if have := bytes.Join(chunks, nil); !bytes.Equal(have, data) {
+		t.Fatal("chunks don't add up to the input")
+	}
+	for i, c := range chunks {
+		if len(c) > maxChunkSize {
+			t.Errorf("chunk %d has %d bytes, more than %d", i, len(c), maxChunkSize)
+		}
+		if len(c) < minChunkSize && i != len(chunks)-1 {
+			t.Errorf("chunk %d has %d bytes, less than %d", i, len(c), minChunkSize)
+		}
+	}
+}
+
+func TestChunkerShift(t *testing.T) {
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	// Inserting bytes near the start only changes the chunks around the edit
+	edited := append([]byte("a few inserted bytes"), data...)
+
+	seen := map[string]bool{}
+	for _, c := range chunkAll(t, data) {
+		seen[string(c)] = true
+	}
+	chunks := chunkAll(t, edited)
+	shared := 0
+	for _, c := range chunks {
+		if seen[string(c)] {
+			shared++
+		}
+	}
+
+	if shared < len(chunks)-2 {
+		t.Errorf("have %d of %d chunks shared after an insert", shared, len(chunks))
+	}
+}
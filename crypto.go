@@ -1,14 +1,41 @@
 package main
 
 import (
+    "bytes"
+    "context"
     "crypto/aes"
     "crypto/cipher"
-    "crypto/md5"
+    "crypto/hmac"
     "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
     "encoding/hex"
+    "errors"
     "io"
 )
 
+// Encrypted streams start with a header of a version byte, a salt from
+// which the stream's key is derived and a nonce prefix. The plaintext
+// follows in fixed-size segments, each sealed with AES-GCM under a nonce
+// made of the prefix, the segment number and a flag marking the final
+// segment, so reordered, truncated or modified streams fail to decrypt.
+const (
+    streamVersion     = 1        // Current encrypted stream format
+    streamSegmentSize = 64 << 10 // Plaintext bytes per sealed segment
+    streamSaltSize    = 16       // Salt deriving the per-stream key
+    streamPrefixSize  = 7        // Fixed part of each segment nonce
+    streamTagSize     = 16       // GCM authentication tag per segment
+    streamHeaderSize  = 1 + streamSaltSize + streamPrefixSize
+)
+
+var (
+    // ErrUnsupportedVersion is returned when decrypting an unknown stream format
+    ErrUnsupportedVersion = errors.New("unsupported encrypted stream version")
+    // ErrAuthentication is returned when encrypted data was modified,
+    // truncated or reordered
+    ErrAuthentication = errors.New("encrypted data failed authentication")
+)
+
 // generateID creates a random 32-byte identifier
 func generateID() string {
     buf := make([]byte, 32)
@@ -16,12 +43,6 @@ func generateID() string {
     return hex.EncodeToString(buf)
 }
 
-// hashKey creates an MD5 hash of a key
-func hashKey(key string) string {
-    hash := md5.Sum([]byte(key))
-    return hex.EncodeToString(hash[:])
-}
-
 // newEncryptionKey generates a random 32-byte encryption key
 func newEncryptionKey() []byte {
     keyBuf := make([]byte, 32)
@@ -29,67 +50,193 @@ func newEncryptionKey() []byte {
     return keyBuf
 }
 
-// copyStream handles the actual encryption/decryption stream copying
-func copyStream(stream cipher.Stream, blockSize int, src io.Reader, dst io.Writer) (int, error) {
+// streamCipher seals and opens the segments of one encrypted stream
+type streamCipher struct {
+    aead   cipher.AEAD
+    header []byte // Authenticated along with every segment
+    nonce  []byte
+}
+
+// newStreamCipher derives the stream key from key and the header's salt
+func newStreamCipher(key []byte, header []byte) (*streamCipher, error) {
+    if header[0] != streamVersion {
+        return nil, ErrUnsupportedVersion
+    }
+
+    mac := hmac.New(sha256.New, key)
+    mac.Write(header[1 : 1+streamSaltSize])
+    block, err := aes.NewCipher(mac.Sum(nil))
+    if err != nil {
+        return nil, err
+    }
+    aead, err := cipher.NewGCM(block)
+    if err != nil {
+        return nil, err
+    }
+
+    nonce := make([]byte, aead.NonceSize())
+    copy(nonce, header[1+streamSaltSize:])
+
+    return &streamCipher{aead: aead, header: header, nonce: nonce}, nil
+}
+
+// segmentNonce sets the nonce for segment i
+func (sc *streamCipher) segmentNonce(i uint32, last bool) []byte {
+    binary.BigEndian.PutUint32(sc.nonce[streamPrefixSize:], i)
+    sc.nonce[len(sc.nonce)-1] = 0
+    if last {
+        sc.nonce[len(sc.nonce)-1] = 1
+    }
+    return sc.nonce
+}
+
+// readSegment fills buf with the next segment plus one byte of lookahead,
+// which tells whether the segment is the final one. The lookahead byte is
+// expected at buf[0] when carried is set.
+func readSegment(src io.Reader, buf []byte, carried bool) (n int, last bool, err error) {
+    if carried {
+        n = 1
+    }
+    nn, err := io.ReadFull(src, buf[n:])
+    n += nn
+    if err == io.EOF || err == io.ErrUnexpectedEOF {
+        return n, true, nil
+    }
+    return n, false, err
+}
+
+// sealStream encrypts src into dst behind the given header
+func sealStream(ctx context.Context, key []byte, header []byte, src io.Reader, dst io.Writer) (int, error) {
+    sc, err := newStreamCipher(key, header)
+    if err != nil {
+        return 0, err
+    }
+
+    nw, err := dst.Write(header)
+    if err != nil {
+        return nw, err
+    }
+
     var (
-        buf = make([]byte, 32*1024) // 32KB buffer
-        nw  = blockSize
+        buf     = make([]byte, streamSegmentSize+1)
+        out     = make([]byte, 0, streamSegmentSize+streamTagSize)
+        carried = false
     )
-    for {
-        n, err := src.Read(buf)
-        if n > 0 {
-            stream.XORKeyStream(buf, buf[:n]) // Encrypt/decrypt
-            nn, err := dst.Write(buf[:n])
-            if err != nil {
-                return 0, err
-            }
-            nw += nn
+    for i := uint32(0); ; i++ {
+        if err := ctx.Err(); err != nil {
+            return nw, err
+        }
+
+        n, last, err := readSegment(src, buf, carried)
+        if err != nil {
+            return nw, err
         }
-        if err == io.EOF {
-            break
+        if !last {
+            n = streamSegmentSize
         }
+
+        out = sc.aead.Seal(out[:0], sc.segmentNonce(i, last), buf[:n], sc.header)
+        nn, err := dst.Write(out)
+        nw += nn
         if err != nil {
-            return 0, err
+            return nw, err
+        }
+        if last {
+            return nw, nil
         }
+
+        buf[0], carried = buf[streamSegmentSize], true
     }
-    return nw, nil
 }
 
-// copyDecrypt decrypts data from src to dst using the provided key
-func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
-    block, err := aes.NewCipher(key) // AES cipher
-    if err != nil {
+// copyDecrypt decrypts data from src to dst using the provided key. It
+// returns the number of plaintext bytes written.
+func copyDecrypt(ctx context.Context, key []byte, src io.Reader, dst io.Writer) (int, error) {
+    header := make([]byte, streamHeaderSize)
+    if _, err := io.ReadFull(src, header); err != nil {
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            err = ErrAuthentication // Truncated within the header
+        }
         return 0, err
     }
-
-    // Read initialization vector
-    iv := make([]byte, block.BlockSize())
-    if _, err := src.Read(iv); err != nil {
+    sc, err := newStreamCipher(key, header)
+    if err != nil {
         return 0, err
     }
 
-    stream := cipher.NewCTR(block, iv) // CTR mode stream
-    return copyStream(stream, block.BlockSize(), src, dst)
+    var (
+        buf     = make([]byte, streamSegmentSize+streamTagSize+1)
+        out     = make([]byte, 0, streamSegmentSize)
+        carried = false
+        nw      = 0
+    )
+    for i := uint32(0); ; i++ {
+        if err := ctx.Err(); err != nil {
+            return nw, err
+        }
+
+        n, last, err := readSegment(src, buf, carried)
+        if err != nil {
+            return nw, err
+        }
+        if !last {
+            n = streamSegmentSize + streamTagSize
+        }
+
+        out, err = sc.aead.Open(out[:0], sc.segmentNonce(i, last), buf[:n], sc.header)
+        if err != nil {
+            return nw, ErrAuthentication
+        }
+        nn, err := dst.Write(out)
+        nw += nn
+        if err != nil {
+            return nw, err
+        }
+        if last {
+            return nw, nil
+        }
+
+        buf[0], carried = buf[streamSegmentSize+streamTagSize], true
+    }
 }
 
 // copyEncrypt encrypts data from src to dst using the provided key
-func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
-    block, err := aes.NewCipher(key) // AES cipher
-    if err != nil {
+func copyEncrypt(ctx context.Context, key []byte, src io.Reader, dst io.Writer) (int, error) {
+    header := make([]byte, streamHeaderSize)
+    header[0] = streamVersion
+    if _, err := io.ReadFull(rand.Reader, header[1:]); err != nil {
         return 0, err
     }
 
-    // Generate random initialization vector
-    iv := make([]byte, block.BlockSize()) // 16 bytes
-    if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-        return 0, err
-    }
+    return sealStream(ctx, key, header, src, dst)
+}
 
-    // Write IV first
-    if _, err := dst.Write(iv); err != nil {
-        return 0, err
+// chunkOverhead is the most bytes encryptChunk adds to a chunk
+const chunkOverhead = streamHeaderSize + (maxChunkSize/streamSegmentSize)*streamTagSize
+
+// encryptChunk encrypts a chunk for storage on peers. The salt and nonce
+// prefix are derived from the key and chunk, so a chunk encrypts identically
+// under its content-derived key and deduplicates on the peers holding it.
+func encryptChunk(key []byte, b []byte) ([]byte, error) {
+    mac := hmac.New(sha256.New, key)
+    mac.Write(b)
+
+    header := make([]byte, streamHeaderSize)
+    header[0] = streamVersion
+    copy(header[1:], mac.Sum(nil))
+
+    out := new(bytes.Buffer)
+    if _, err := sealStream(context.Background(), key, header, bytes.NewReader(b), out); err != nil {
+        return nil, err
     }
+    return out.Bytes(), nil
+}
 
-    stream := cipher.NewCTR(block, iv) // CTR mode stream
-    return copyStream(stream, block.BlockSize(), src, dst)
-}
\ No newline at end of file
+// decryptChunk decrypts a chunk encrypted with encryptChunk
+func decryptChunk(key []byte, b []byte) ([]byte, error) {
+    out := new(bytes.Buffer)
+    if _, err := copyDecrypt(context.Background(), key, bytes.NewReader(b), out); err != nil {
+        return nil, err
+    }
+    return out.Bytes(), nil
+}
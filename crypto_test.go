@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"testing"
 )
 
@@ -11,7 +14,7 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 	src := bytes.NewReader([]byte(payload))
 	dst := new(bytes.Buffer)
 	key := newEncryptionKey()
-	_, err := copyEncrypt(key, src, dst)
+	_, err := copyEncrypt(context.Background(), key, src, dst)
 	if err != nil {
 		t.Error(err)
 	}
@@ -20,16 +23,113 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 	fmt.Println(len(dst.String()))
 
 	out := new(bytes.Buffer)
-	nw, err := copyDecrypt(key, dst, out)
+	nw, err := copyDecrypt(context.Background(), key, dst, out)
 	if err != nil {
 		t.Error(err)
 	}
 
-	if nw != 16+len(payload) {
-		t.Fail()
+	if nw != len(payload) {
+		t.Errorf("have %d bytes decrypted want %d", nw, len(payload))
 	}
 
 	if out.String() != payload {
 		t.Errorf("decryption failed!!!")
 	}
 }
+
+func TestCopyEncryptCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := copyEncrypt(ctx, newEncryptionKey(), bytes.NewReader([]byte("payload")), new(bytes.Buffer))
+	if err != context.Canceled {
+		t.Errorf("have %v want %v", err, context.Canceled)
+	}
+}
+
+func TestCopyDecryptDetectsTampering(t *testing.T) {
+	key := newEncryptionKey()
+	payload := make([]byte, 3*streamSegmentSize+100)
+	rand.New(rand.NewSource(1)).Read(payload)
+
+	encrypted := new(bytes.Buffer)
+	if _, err := copyEncrypt(context.Background(), key, bytes.NewReader(payload), encrypted); err != nil {
+		t.Fatal(err)
+	}
+	ct := encrypted.Bytes()
+	segment := streamSegmentSize + streamTagSize
+
+	flipped := append([]byte(nil), ct...)
+	flipped[streamHeaderSize+10] ^= 1
+
+	reordered := append([]byte(nil), ct[:streamHeaderSize]...)
+	reordered = append(reordered, ct[streamHeaderSize+segment:streamHeaderSize+2*segment]...)
+	reordered = append(reordered, ct[streamHeaderSize:streamHeaderSize+segment]...)
+	reordered = append(reordered, ct[streamHeaderSize+2*segment:]...)
+
+	version := append([]byte(nil), ct...)
+	version[0] = streamVersion + 1
+
+	tests := map[string]struct {
+		data []byte
+		err  error
+	}{
+		"flipped bit":           {flipped, ErrAuthentication},
+		"reordered segments":    {reordered, ErrAuthentication},
+		"truncated at boundary": {ct[:streamHeaderSize+2*segment], ErrAuthentication},
+		"truncated mid segment": {ct[:len(ct)-5], ErrAuthentication},
+		"truncated header":      {ct[:streamHeaderSize-1], ErrAuthentication},
+		"unknown version":       {version, ErrUnsupportedVersion},
+	}
+	for name, tt := range tests {
+		_, err := copyDecrypt(context.Background(), key, bytes.NewReader(tt.data), new(bytes.Buffer))
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: have %v want %v", name, err, tt.err)
+		}
+	}
+}
+
+func TestEncryptChunkDeterministic(t *testing.T) {
+	key := newEncryptionKey()
+	chunk := []byte("some chunk of a build artifact")
+
+	a, err := encryptChunk(key, chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := encryptChunk(key, chunk)
+	if !bytes.Equal(a, b) {
+		t.Error("identical chunks encrypted differently")
+	}
+
+	plain, err := decryptChunk(key, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, chunk) {
+		t.Errorf("have %q want %q", plain, chunk)
+	}
+}
+
+func TestCopyEncryptSegmentBoundaries(t *testing.T) {
+	key := newEncryptionKey()
+	for _, size := range []int{0, 1, streamSegmentSize, streamSegmentSize + 1, 2 * streamSegmentSize, maxChunkSize} {
+		payload := bytes.Repeat([]byte{'x'}, size)
+
+		encrypted := new(bytes.Buffer)
+		if _, err := copyEncrypt(context.Background(), key, bytes.NewReader(payload), encrypted); err != nil {
+			t.Fatal(err)
+		}
+		if size == maxChunkSize && encrypted.Len() != size+chunkOverhead {
+			t.Errorf("have %d encrypted bytes want %d", encrypted.Len(), size+chunkOverhead)
+		}
+
+		out := new(bytes.Buffer)
+		if _, err := copyDecrypt(context.Background(), key, encrypted, out); err != nil {
+			t.Errorf("size %d: %s", size, err)
+		}
+		if !bytes.Equal(out.Bytes(), payload) {
+			t.Errorf("size %d: decrypted different content", size)
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/bits"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/utkarshgupta2804/p2p-filestorage/p2p"
+)
+
+const (
+	bucketSize  = 20  // k, contacts per bucket and nodes queried for a key
+	lookupAlpha = 3   // Concurrent requests per lookup round
+	idBits      = 256 // Size of the keyspace in bits
+)
+
+// NodeID is a position in the DHT keyspace
+type NodeID [idBits / 8]byte
+
+// toNodeID maps a node ID string into the keyspace. Hex encoded 256-bit IDs
+// are used as is, anything else (e.g. an address) is hashed.
+func toNodeID(id string) NodeID {
+	var n NodeID
+	if b, err := hex.DecodeString(id); err == nil && len(b) == len(n) {
+		copy(n[:], b)
+		return n
+	}
+	return sha256.Sum256([]byte(id))
+}
+
+// keyNodeID maps a hashed file key into the keyspace
+func keyNodeID(hashedKey string) NodeID {
+	return sha256.Sum256([]byte(hashedKey))
+}
+
+// xor returns the XOR distance between two IDs
+func (n NodeID) xor(o NodeID) NodeID {
+	var d NodeID
+	for i := range n {
+		d[i] = n[i] ^ o[i]
+	}
+	return d
+}
+
+// leadingZeros returns the number of leading zero bits
+func (n NodeID) leadingZeros() int {
+	for i, b := range n {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return idBits
+}
+
+// Contact is a node that can be reached over the network
+type Contact struct {
+	ID   string // Node ID
+	Addr string // Dialable listen address
+}
+
+// sortContacts orders contacts by XOR distance to target, closest first
+func sortContacts(contacts []Contact, target NodeID) {
+	sort.Slice(contacts, func(i, j int) bool {
+		di := toNodeID(contacts[i].ID).xor(target)
+		dj := toNodeID(contacts[j].ID).xor(target)
+		return bytes.Compare(di[:], dj[:]) < 0
+	})
+}
+
+// routingTable holds k-buckets of contacts indexed by shared prefix length
+// with the local node
+type routingTable struct {
+	self NodeID
+
+	lock    sync.Mutex
+	buckets [idBits][]Contact // Each bucket ordered least to most recently seen
+}
+
+// newRoutingTable creates an empty routing table for self
+func newRoutingTable(self NodeID) *routingTable {
+	return &routingTable{self: self}
+}
+
+// update records the contact as most recently seen. When its bucket is full
+// the least recently seen contact is evicted, unless isLive reports it is
+// still reachable, in which case the new contact is dropped. It reports
+// whether the contact is new to the table and which contact was evicted.
+func (rt *routingTable) update(c Contact, isLive func(string) bool) (added bool, evicted string) {
+	i := toNodeID(c.ID).xor(rt.self).leadingZeros()
+	if i == idBits || len(c.Addr) == 0 {
+		return false, "" // Never route to ourselves or to an undialable contact
+	}
+
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	added = true
+	bucket := rt.buckets[i]
+	for j, existing := range bucket {
+		if existing.ID == c.ID {
+			bucket = append(bucket[:j], bucket[j+1:]...)
+			added = false
+			break
+		}
+	}
+
+	if len(bucket) >= bucketSize {
+		if isLive(bucket[0].ID) {
+			return false, ""
+		}
+		evicted = bucket[0].ID
+		bucket = bucket[1:]
+	}
+
+	rt.buckets[i] = append(bucket, c)
+
+	return added, evicted
+}
+
+// remove drops a contact from the table, reporting whether it was present
+func (rt *routingTable) remove(id string) bool {
+	i := toNodeID(id).xor(rt.self).leadingZeros()
+	if i == idBits {
+		return false
+	}
+
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	bucket := rt.buckets[i]
+	for j, existing := range bucket {
+		if existing.ID == id {
+			rt.buckets[i] = append(bucket[:j], bucket[j+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// contact returns the known contact with the given node ID
+func (rt *routingTable) contact(id string) (Contact, bool) {
+	i := toNodeID(id).xor(rt.self).leadingZeros()
+	if i == idBits {
+		return Contact{}, false
+	}
+
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	for _, c := range rt.buckets[i] {
+		if c.ID == id {
+			return c, true
+		}
+	}
+
+	return Contact{}, false
+}
+
+// closest returns up to n known contacts closest to target
+func (rt *routingTable) closest(target NodeID, n int) []Contact {
+	rt.lock.Lock()
+	contacts := []Contact{}
+	for _, bucket := range rt.buckets {
+		contacts = append(contacts, bucket...)
+	}
+	rt.lock.Unlock()
+
+	sortContacts(contacts, target)
+	if len(contacts) > n {
+		contacts = contacts[:n]
+	}
+	return contacts
+}
+
+// all returns every known contact
+func (rt *routingTable) all() []Contact {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	contacts := []Contact{}
+	for _, bucket := range rt.buckets {
+		contacts = append(contacts, bucket...)
+	}
+	return contacts
+}
+
+// MessageFindNode asks for the contacts closest to Target
+type MessageFindNode struct {
+	Target NodeID // Keyspace position to look up
+}
+
+// MessageFindValue asks whether a file is held, and for contacts closest to
+// it. There is no STORE request, files are offered to their owners on the
+// placement ring with MessageStoreFile instead.
+type MessageFindValue struct {
+	ID  string // File owner ID
+	Key string // File key
+}
+
+// MessageNodes answers MessageFindNode and MessageFindValue
+type MessageNodes struct {
+	Found    bool      // Responder holds the requested file
+	Epoch    string    // Identifies the chunk keys of the responder's copy
+	Contacts []Contact // Closest contacts known to the responder
+}
+
+// peer returns the connected peer with the given node ID
+func (s *FileServer) peer(id string) (p2p.Peer, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	p, ok := s.peers[id]
+	return p, ok
+}
+
+// isConnected reports whether a node currently has a live connection
+func (s *FileServer) isConnected(id string) bool {
+	_, ok := s.peer(id)
+	return ok
+}
+
+// contactAddr builds a dialable address from a peer's advertised listen
+// address, filling in the host it connected from when none was advertised
+func contactAddr(advertised string, remote net.Addr) string {
+	host, port, err := net.SplitHostPort(advertised)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); len(host) == 0 || (ip != nil && ip.IsUnspecified()) {
+		if remoteHost, _, err := net.SplitHostPort(remote.String()); err == nil {
+			host = remoteHost
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// observe refreshes the routing table with a peer that sent us a message
+func (s *FileServer) observe(from string, addr string) {
+	if len(addr) == 0 {
+		return
+	}
+	peer, ok := s.peer(from)
+	if !ok {
+		return
+	}
+	s.addContact(Contact{ID: from, Addr: contactAddr(addr, peer.RemoteAddr())})
+}
+
+// addContact records a reachable node in the routing table and the
+// placement ring
+func (s *FileServer) addContact(c Contact) {
+	added, evicted := s.rt.update(c, s.isConnected)
+	if len(evicted) > 0 {
+		s.ring.remove(evicted)
+	}
+	if added {
+		s.ring.add(c.ID)
+		if err := s.book.connected(c); err != nil {
+			log.Printf("[%s] saving address book failed: %s", s.Transport.Addr(), err)
+		}
+	}
+	if added || len(evicted) > 0 {
+		s.scheduleRebalance()
+	}
+}
+
+// removeContact forgets a node that can no longer be reached
+func (s *FileServer) removeContact(id string) {
+	if s.rt.remove(id) {
+		s.ring.remove(id)
+		s.scheduleRebalance()
+	}
+}
+
+// dialContact returns a connection to the contact, dialing it when needed
+func (s *FileServer) dialContact(c Contact) (p2p.Peer, error) {
+	if peer, ok := s.peer(c.ID); ok {
+		return peer, nil
+	}
+
+	peer, err := s.Transport.Dial(c.Addr)
+	if err != nil {
+		// A concurrent dial may have won the race
+		if peer, ok := s.peer(c.ID); ok {
+			return peer, nil
+		}
+		return nil, err
+	}
+
+	if peer.ID() != c.ID {
+		// Don't keep a connection under an ID other than the one dialed
+		peer.Close()
+		return nil, fmt.Errorf("[%s] dialed %s expecting node %s, got %s", s.Transport.Addr(), c.Addr, c.ID, peer.ID())
+	}
+
+	s.addContact(c)
+
+	return peer, nil
+}
+
+// lookupResult is the outcome of querying a single contact during a lookup
+type lookupResult struct {
+	contact Contact
+	nodes   MessageNodes
+	err     error
+}
+
+// query sends a lookup request to a single contact
+func (s *FileServer) query(ctx context.Context, c Contact, payload any) lookupResult {
+	peer, err := s.dialContact(c)
+	if err != nil {
+		return lookupResult{contact: c, err: err}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rpcTimeout)
+	defer cancel()
+
+	reply, err := s.call(ctx, peer, payload)
+	if err != nil {
+		return lookupResult{contact: c, err: err}
+	}
+
+	nodes, ok := reply.Payload.(MessageNodes)
+	if !ok {
+		return lookupResult{contact: c, err: fmt.Errorf("unexpected reply %T", reply.Payload)}
+	}
+
+	return lookupResult{contact: c, nodes: nodes}
+}
+
+// lookup runs an iterative Kademlia lookup for target and returns the k
+// closest nodes that answered. When find is set the nodes are asked for the
+// file instead, and the lookup stops at the first round that finds holders.
+// Cancelling ctx ends the lookup with the contacts found so far.
+func (s *FileServer) lookup(ctx context.Context, target NodeID, find *MessageFindValue) (closest []Contact, holders []Contact) {
+	var payload any = MessageFindNode{Target: target}
+	if find != nil {
+		payload = *find
+	}
+
+	var (
+		shortlist = s.rt.closest(target, bucketSize)
+		seen      = map[string]bool{s.ID: true}
+		queried   = map[string]bool{}
+	)
+	for _, c := range shortlist {
+		seen[c.ID] = true
+	}
+
+	for {
+		// Query the closest contacts we haven't asked yet
+		sortContacts(shortlist, target)
+		batch := []Contact{}
+		for i := 0; i < len(shortlist) && i < bucketSize && len(batch) < lookupAlpha; i++ {
+			if c := shortlist[i]; !queried[c.ID] {
+				queried[c.ID] = true
+				batch = append(batch, c)
+			}
+		}
+		if len(batch) == 0 || ctx.Err() != nil {
+			break
+		}
+
+		results := make(chan lookupResult, len(batch))
+		for _, c := range batch {
+			go func(c Contact) {
+				results <- s.query(ctx, c, payload)
+			}(c)
+		}
+
+		failed := map[string]bool{}
+		for range batch {
+			res := <-results
+			if res.err != nil {
+				log.Printf("[%s] lookup query to %s failed: %s", s.Transport.Addr(), res.contact.Addr, res.err)
+				failed[res.contact.ID] = true
+				if ctx.Err() == nil && !s.isConnected(res.contact.ID) {
+					s.removeContact(res.contact.ID)
+				}
+				continue
+			}
+
+			closest = append(closest, res.contact)
+			if res.nodes.Found {
+				holders = append(holders, res.contact)
+			}
+			for _, c := range res.nodes.Contacts {
+				if !seen[c.ID] {
+					seen[c.ID] = true
+					shortlist = append(shortlist, c)
+				}
+			}
+		}
+
+		// Unreachable contacts make room for the next closest ones
+		alive := shortlist[:0]
+		for _, c := range shortlist {
+			if !failed[c.ID] {
+				alive = append(alive, c)
+			}
+		}
+		shortlist = alive
+
+		if len(holders) > 0 {
+			break
+		}
+	}
+
+	sortContacts(closest, target)
+	if len(closest) > bucketSize {
+		closest = closest[:bucketSize]
+	}
+
+	return closest, holders
+}
+
+// closestContacts returns the contacts closest to target excluding the requester
+func (s *FileServer) closestContacts(target NodeID, exclude string) []Contact {
+	contacts := []Contact{}
+	for _, c := range s.rt.closest(target, bucketSize+1) {
+		if c.ID != exclude && len(contacts) < bucketSize {
+			contacts = append(contacts, c)
+		}
+	}
+	return contacts
+}
+
+// handleMessageFindNode answers a FIND_NODE request
+func (s *FileServer) handleMessageFindNode(from string, id uint64, msg MessageFindNode) error {
+	return s.respond(from, id, MessageNodes{
+		Contacts: s.closestContacts(msg.Target, from),
+	})
+}
+
+// handleMessageFindValue answers a FIND_VALUE request
+func (s *FileServer) handleMessageFindValue(from string, id uint64, msg MessageFindValue) error {
+	res := MessageNodes{Contacts: s.closestContacts(keyNodeID(msg.Key), from)}
+	if m, err := s.store.ReadManifest(msg.ID, msg.Key); err == nil {
+		res.Found, res.Epoch = true, m.Epoch
+	}
+	return s.respond(from, id, res)
+}
+
+func init() {
+	gob.Register(MessageFindNode{})
+	gob.Register(MessageFindValue{})
+	gob.Register(MessageNodes{})
+}
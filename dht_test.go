@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/utkarshgupta2804/p2p-filestorage/p2p"
+)
+
+func TestNodeIDDistance(t *testing.T) {
+	var a, b NodeID
+	b[0] = 0x10
+
+	if have := a.xor(b).leadingZeros(); have != 3 {
+		t.Errorf("have %d want 3", have)
+	}
+	if have := a.xor(a).leadingZeros(); have != idBits {
+		t.Errorf("have %d want %d", have, idBits)
+	}
+}
+
+func TestRoutingTableClosest(t *testing.T) {
+	self := toNodeID(generateID())
+	rt := newRoutingTable(self)
+
+	contacts := []Contact{}
+	for i := 0; i < bucketSize; i++ {
+		c := Contact{ID: generateID(), Addr: fmt.Sprintf("127.0.0.1:%d", 4000+i)}
+		contacts = append(contacts, c)
+		rt.update(c, func(string) bool { return false })
+	}
+
+	target := toNodeID(generateID())
+	sortContacts(contacts, target)
+
+	closest := rt.closest(target, 5)
+	if len(closest) != 5 {
+		t.Fatalf("have %d contacts want 5", len(closest))
+	}
+
+	for i, c := range closest {
+		if c.ID != contacts[i].ID {
+			t.Errorf("contact %d: have %s want %s", i, c.ID, contacts[i].ID)
+		}
+	}
+}
+
+func TestRoutingTableFullBucket(t *testing.T) {
+	var self NodeID
+	rt := newRoutingTable(self)
+
+	// IDs with the top bit set all land in bucket 0
+	newContact := func(i int) Contact {
+		var id NodeID
+		id[0] = 0x80
+		id[31] = byte(i)
+		return Contact{ID: fmt.Sprintf("%x", id[:]), Addr: fmt.Sprintf("127.0.0.1:%d", 4000+i)}
+	}
+
+	for i := 0; i < bucketSize; i++ {
+		rt.update(newContact(i), nil)
+	}
+
+	// A live oldest contact keeps its place
+	rt.update(newContact(bucketSize), func(string) bool { return true })
+	if rt.buckets[0][0].ID != newContact(0).ID {
+		t.Errorf("live contact was evicted")
+	}
+
+	// A dead one makes room for the newcomer
+	rt.update(newContact(bucketSize), func(string) bool { return false })
+	if n := len(rt.buckets[0]); n != bucketSize {
+		t.Errorf("have %d contacts want %d", n, bucketSize)
+	}
+	if last := rt.buckets[0][bucketSize-1]; last.ID != newContact(bucketSize).ID {
+		t.Errorf("newcomer was not added")
+	}
+}
+
+func TestDialContactClosesUnexpectedNode(t *testing.T) {
+	t.Parallel()
+
+	network := p2p.NewMemoryNetwork()
+	s1 := newTestServer(t, network, filepath.Join(t.TempDir(), "s1"))
+	s2 := newTestServer(t, network, filepath.Join(t.TempDir(), "s2"))
+
+	if _, err := s1.dialContact(Contact{ID: generateID(), Addr: s2.Transport.Addr()}); err == nil {
+		t.Fatal("dialed a node other than the contact")
+	}
+	waitFor(t, "the connection closed", func() bool {
+		return !s1.isConnected(s2.ID) && !s2.isConnected(s1.ID)
+	})
+	if _, ok := s1.rt.contact(s2.ID); ok {
+		t.Error("unexpected node added to the routing table")
+	}
+}
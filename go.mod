@@ -2,10 +2,15 @@ module github.com/utkarshgupta2804/p2p-filestorage
 
 go 1.18
 
+require (
+	github.com/stretchr/testify v1.8.1
+	golang.org/x/crypto v0.14.0
+	lukechampine.com/blake3 v1.3.0
+)
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.11 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/objx v0.5.0 // indirect
-	github.com/stretchr/testify v1.8.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
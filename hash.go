@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"lukechampine.com/blake3"
+)
+
+// HashFunc digests data into the hex string keys and paths are named by
+type HashFunc func(data []byte) string
+
+// SHA256Hash hashes data with SHA-256, the default everywhere
+func SHA256Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// BLAKE3Hash hashes data with 256-bit BLAKE3
+func BLAKE3Hash(data []byte) string {
+	sum := blake3.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// SHA1Hash hashes data with SHA-1, which named storage paths in earlier
+// releases. Only use it to read a storage root that wasn't migrated.
+func SHA1Hash(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// MD5Hash hashes data with MD5, which named files on the network in earlier
+// releases. Only use it to talk to nodes that still do.
+func MD5Hash(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashFuncs are the hash functions selectable by name
+var hashFuncs = map[string]HashFunc{
+	"sha256": SHA256Hash,
+	"blake3": BLAKE3Hash,
+	"sha1":   SHA1Hash,
+	"md5":    MD5Hash,
+}
+
+// HashFuncByName returns the hash function called name, as accepted by
+// configuration and the migrate command
+func HashFuncByName(name string) (HashFunc, error) {
+	hash, ok := hashFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash %q", name)
+	}
+	return hash, nil
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	indexFileName   = "index.log" // Index log under the storage root
+	indexCompactMin = 1024        // Records the log may grow to before compacting
+)
+
+// FileInfo describes a stored file
+type FileInfo struct {
+	ID      string    // Node the file belongs to
+	Key     string    // Key the file was stored under
+	Path    string    // Manifest location under the root
+	Size    int64     // File size in bytes
+	Digest  string    // SHA-256 over the chunk hashes, equal for equal contents
+	Created time.Time // When the origin stored the file
+}
+
+// indexRecord is a line of the index log
+type indexRecord struct {
+	FileInfo
+	Chunks  []string `json:",omitempty"` // Hashes of the file's chunks
+	Deleted bool     `json:",omitempty"` // The file was removed
+	Pending bool     `json:",omitempty"` // The file's manifest is about to be written
+}
+
+// storeIndex maps the keys of stored files to their metadata and counts
+// the files using each chunk. It is kept in memory and persisted as an
+// append-only log of changes under the root, which is compacted once mostly
+// stale.
+type storeIndex struct {
+	path string // Log location
+
+	lock    sync.Mutex
+	files    map[string]map[string]indexRecord // By ID, then key
+	refs     map[string]int                    // Files using each chunk, by hash
+	log      *os.File                          // Open for appending once written to
+	records  int                               // Records in the log
+	inflight int                               // Manifests being written, the log isn't compacted meanwhile
+}
+
+// manifestDigest identifies the contents of a file by its chunks
+func manifestDigest(m *Manifest) string {
+	h := sha256.New()
+	for _, c := range m.Chunks {
+		fmt.Fprintln(h, c.Hash)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// chunkHashes lists the hashes of a manifest's chunks
+func chunkHashes(m *Manifest) []string {
+	hashes := make([]string, len(m.Chunks))
+	for i, c := range m.Chunks {
+		hashes[i] = c.Hash
+	}
+	return hashes
+}
+
+// fileInfo describes the file with the given manifest
+func (s *Store) fileInfo(id string, key string, m *Manifest) FileInfo {
+	created := time.Now()
+	if m.Created != 0 {
+		created = time.Unix(0, m.Created)
+	}
+	return FileInfo{
+		ID:      id,
+		Key:     key,
+		Path:    fmt.Sprintf("%s/%s", id, s.PathTransformFunc(key).FullPath()),
+		Size:    m.Size,
+		Digest:  manifestDigest(m),
+		Created: created,
+	}
+}
+
+// Stat returns the metadata of the file stored for the given ID and key
+func (s *Store) Stat(id string, key string) (FileInfo, error) {
+	idx := s.loadIndex()
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	rec, ok := idx.files[id][key]
+	if !ok {
+		return FileInfo{}, fmt.Errorf("stat %s: %w", key, os.ErrNotExist)
+	}
+	return rec.FileInfo, nil
+}
+
+// List returns the files stored for the given ID whose keys start with
+// prefix, sorted by key
+func (s *Store) List(id string, prefix string) []FileInfo {
+	idx := s.loadIndex()
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	files := []FileInfo{}
+	for key, rec := range idx.files[id] {
+		if strings.HasPrefix(key, prefix) {
+			files = append(files, rec.FileInfo)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Key < files[j].Key })
+	return files
+}
+
+// Walk calls fn for every stored file, ordered by ID and key. It stops at
+// the first error fn returns and returns it.
+func (s *Store) Walk(fn func(info FileInfo) error) error {
+	idx := s.loadIndex()
+	idx.lock.Lock()
+	files := []FileInfo{}
+	for _, byKey := range idx.files {
+		for _, rec := range byKey {
+			files = append(files, rec.FileInfo)
+		}
+	}
+	idx.lock.Unlock()
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].ID != files[j].ID {
+			return files[i].ID < files[j].ID
+		}
+		return files[i].Key < files[j].Key
+	})
+	for _, info := range files {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadIndex returns the index, reading it on first use. A missing or
+// damaged log is rebuilt from the manifests, which record their keys.
+func (s *Store) loadIndex() *storeIndex {
+	s.indexOnce.Do(func() {
+		s.index = &storeIndex{path: filepath.Join(s.Root, indexFileName)}
+		err := s.index.replay()
+		if err == nil {
+			return
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("index %s damaged, rebuilding it: %s", s.index.path, err)
+		}
+		if err := s.rebuildIndex(); err != nil {
+			log.Printf("rebuilding index %s failed: %s", s.index.path, err)
+		}
+	})
+	return s.index
+}
+
+// rebuildIndex recreates the index from the manifests under the root
+func (s *Store) rebuildIndex() error {
+	records := []indexRecord{}
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == chunkFolderName && filepath.Dir(path) == filepath.Clean(s.Root) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.Root, path)
+		if err != nil || !strings.Contains(rel, string(filepath.Separator)) {
+			return err // Files in the root itself aren't manifests
+		}
+		m, err := loadManifest(path)
+		if err != nil || len(m.Key) == 0 {
+			return nil // Not a manifest, or one from before keys were recorded
+		}
+
+		id := strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+		records = append(records, indexRecord{FileInfo: s.fileInfo(id, m.Key, m), Chunks: chunkHashes(m)})
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil // Nothing stored yet
+	}
+
+	idx := s.index
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	idx.files, idx.refs = map[string]map[string]indexRecord{}, map[string]int{}
+	for _, rec := range records {
+		idx.apply(rec)
+	}
+	if err != nil {
+		return err
+	}
+	if _, statErr := os.Stat(s.Root); statErr != nil {
+		return nil // Written along with the first file
+	}
+	return idx.compact()
+}
+
+// replay reads the log into memory
+func (idx *storeIndex) replay() error {
+	b, err := os.ReadFile(idx.path)
+	if err != nil {
+		return err
+	}
+
+	idx.files, idx.refs = map[string]map[string]indexRecord{}, map[string]int{}
+	pending := map[[2]string]indexRecord{}
+	lines := bytes.Split(b, []byte("\n"))
+	for _, line := range lines[:len(lines)-1] {
+		var rec indexRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return err
+		}
+		idx.records++
+		if rec.Pending {
+			pending[[2]string{rec.ID, rec.Key}] = rec
+			continue
+		}
+		delete(pending, [2]string{rec.ID, rec.Key})
+		idx.apply(rec)
+	}
+
+	// A crash between writing a manifest and recording it leaves a pending
+	// record behind, which only counts if the manifest made it to disk
+	for _, rec := range pending {
+		m, err := loadManifest(filepath.Join(filepath.Dir(idx.path), rec.Path))
+		if err == nil && m.Key == rec.Key && manifestDigest(m) == rec.Digest {
+			rec.Pending = false
+			idx.apply(rec)
+		}
+	}
+
+	// A crash while appending leaves a partial last line behind
+	if len(lines[len(lines)-1]) > 0 || len(pending) > 0 || idx.records > 2*idx.live()+indexCompactMin {
+		idx.lock.Lock()
+		defer idx.lock.Unlock()
+		return idx.compact()
+	}
+	return nil
+}
+
+// apply updates the files and chunk references in memory, must be called
+// with the lock held unless the index isn't shared yet
+func (idx *storeIndex) apply(rec indexRecord) {
+	if old, ok := idx.files[rec.ID][rec.Key]; ok {
+		for _, hash := range old.Chunks {
+			if idx.refs[hash]--; idx.refs[hash] <= 0 {
+				delete(idx.refs, hash)
+			}
+		}
+	}
+
+	if rec.Deleted {
+		delete(idx.files[rec.ID], rec.Key)
+		if len(idx.files[rec.ID]) == 0 {
+			delete(idx.files, rec.ID)
+		}
+		return
+	}
+	if idx.files[rec.ID] == nil {
+		idx.files[rec.ID] = map[string]indexRecord{}
+	}
+	idx.files[rec.ID][rec.Key] = rec
+	for _, hash := range rec.Chunks {
+		idx.refs[hash]++
+	}
+}
+
+// used reports whether an indexed file uses the chunk with the given hash
+func (idx *storeIndex) used(hash string) bool {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	return idx.refs[hash] > 0
+}
+
+// live returns the number of files indexed
+func (idx *storeIndex) live() int {
+	n := 0
+	for _, byKey := range idx.files {
+		n += len(byKey)
+	}
+	return n
+}
+
+// prepare records that the manifest of a file is about to be written, so a
+// crash before the file is recorded as written is caught on replay. Every
+// prepare must be followed by a commit.
+func (idx *storeIndex) prepare(info FileInfo, chunks []string) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	if err := idx.append(indexRecord{FileInfo: info, Chunks: chunks, Pending: true}); err != nil {
+		return err
+	}
+	idx.inflight++
+	return nil
+}
+
+// commit records a prepared file once its manifest was written, or just
+// ends the write when it failed. The prepared record already makes the file
+// durable, so failing to log its commit only delays compaction.
+func (idx *storeIndex) commit(info FileInfo, chunks []string, written bool) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	idx.inflight--
+	if !written {
+		return
+	}
+	rec := indexRecord{FileInfo: info, Chunks: chunks}
+	idx.apply(rec)
+	if err := idx.append(rec); err != nil {
+		log.Printf("index %s: recording %s failed, it is recovered on replay: %s", idx.path, info.Key, err)
+		return
+	}
+	if err := idx.compactIfStale(); err != nil {
+		log.Printf("index %s: compacting failed: %s", idx.path, err)
+	}
+}
+
+// remove records a deleted file
+func (idx *storeIndex) remove(id string, key string) error {
+	idx.lock.Lock()
+	_, ok := idx.files[id][key]
+	idx.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	return idx.record(indexRecord{FileInfo: FileInfo{ID: id, Key: key}, Deleted: true})
+}
+
+// record appends a change to the log and applies it once it is on disk
+func (idx *storeIndex) record(rec indexRecord) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	if err := idx.append(rec); err != nil {
+		return err
+	}
+	idx.apply(rec)
+	return idx.compactIfStale()
+}
+
+// append writes a record to the log and syncs it, must be called with the
+// lock held
+func (idx *storeIndex) append(rec indexRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if idx.log == nil {
+		if idx.log, err = os.OpenFile(idx.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+			return err
+		}
+	}
+	if _, err := idx.log.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err := idx.log.Sync(); err != nil {
+		return err
+	}
+	idx.records++
+	return nil
+}
+
+// compactIfStale compacts the log once it is mostly stale and no manifest
+// is being written, whose prepared record compacting would drop. It must be
+// called with the lock held.
+func (idx *storeIndex) compactIfStale() error {
+	if idx.inflight > 0 || idx.records <= 2*idx.live()+indexCompactMin {
+		return nil
+	}
+	return idx.compact()
+}
+
+// compact rewrites the log with one record per file, must be called with
+// the lock held
+func (idx *storeIndex) compact() error {
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	records := 0
+	for _, byKey := range idx.files {
+		for _, rec := range byKey {
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+			records++
+		}
+	}
+
+	if idx.log != nil {
+		idx.log.Close()
+		idx.log = nil
+	}
+	if err := writeFileAtomic(idx.path, buf.Bytes()); err != nil {
+		return err
+	}
+	idx.records = records
+	return nil
+}
+
+// reset forgets all files, for a store whose root was removed
+func (idx *storeIndex) reset() {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	if idx.log != nil {
+		idx.log.Close()
+		idx.log = nil
+	}
+	idx.files, idx.refs = map[string]map[string]indexRecord{}, map[string]int{}
+	idx.records = 0
+}
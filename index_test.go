@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreIndex(t *testing.T) {
+	opts := StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc}
+	s := NewStore(opts)
+	alice, bob := generateID(), generateID()
+
+	files := map[string]string{
+		"photos/a.jpg": "same bytes",
+		"photos/b.jpg": "other bytes",
+		"docs/c.txt":   "same bytes",
+	}
+	for key, data := range files {
+		if _, err := s.Write(alice, key, bytes.NewReader([]byte(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Write(bob, "photos/x.jpg", bytes.NewReader([]byte("bob's"))); err != nil {
+		t.Fatal(err)
+	}
+
+	photos := s.List(alice, "photos/")
+	if len(photos) != 2 || photos[0].Key != "photos/a.jpg" || photos[1].Key != "photos/b.jpg" {
+		t.Errorf("have %+v want alice's two photos in order", photos)
+	}
+
+	info, err := s.Stat(alice, "docs/c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len("same bytes")) || info.ID != alice || info.Created.IsZero() {
+		t.Errorf("have %+v", info)
+	}
+	if filepath.Join(s.Root, info.Path) != filepath.Clean(s.manifestPath(alice, "docs/c.txt")) {
+		t.Errorf("have path %s want the manifest", info.Path)
+	}
+	if info.Digest != photos[0].Digest || info.Digest == photos[1].Digest {
+		t.Error("digests don't follow the contents")
+	}
+
+	if err := s.Delete(alice, "photos/b.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat(alice, "photos/b.jpg"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("have %v want %v", err, os.ErrNotExist)
+	}
+
+	walked := 0
+	if err := s.Walk(func(FileInfo) error { walked++; return nil }); err != nil || walked != 3 {
+		t.Errorf("have walked %d files, %v want 3", walked, err)
+	}
+	stop := errors.New("stop")
+	if err := s.Walk(func(FileInfo) error { return stop }); err != stop {
+		t.Errorf("have %v want the error stopping the walk", err)
+	}
+
+	// The index survives a restart, a crash halfway through an append and
+	// losing the log altogether
+	path := filepath.Join(opts.Root, indexFileName)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"ID":"`))
+	f.Close()
+
+	for _, damage := range []string{"partial", "removed"} {
+		if damage == "removed" {
+			if err := os.Remove(path); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		reopened := NewStore(opts)
+		if have := reopened.List(alice, ""); len(have) != 2 {
+			t.Errorf("%s: have %d files for alice want 2", damage, len(have))
+		}
+		if _, err := reopened.Stat(bob, "photos/x.jpg"); err != nil {
+			t.Errorf("%s: %s", damage, err)
+		}
+	}
+}
+
+func TestStoreIndexCountsChunkReferences(t *testing.T) {
+	opts := StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc}
+	s := NewStore(opts)
+	id := generateID()
+
+	for _, key := range []string{"a", "b"} {
+		if _, err := s.Write(id, key, bytes.NewReader([]byte("shared bytes"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A reopened store counts the references from its log
+	s = NewStore(opts)
+	if _, err := s.Write(id, "a", bytes.NewReader([]byte("new bytes"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, r, err := s.Read(id, "b"); err != nil {
+		t.Fatal(err)
+	} else if b, err := io.ReadAll(r); err != nil || string(b) != "shared bytes" {
+		t.Errorf("have %q, %v after overwriting a file sharing its chunks", b, err)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		if err := s.Delete(id, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := countChunks(t, s); n != 0 {
+		t.Errorf("have %d chunks left want 0", n)
+	}
+}
+
+func TestStoreIndexRecoversInterruptedWrites(t *testing.T) {
+	opts := StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc}
+	s := NewStore(opts)
+	id := generateID()
+
+	if _, err := s.Write(id, "a", bytes.NewReader([]byte("some bytes"))); err != nil {
+		t.Fatal(err)
+	}
+	m, err := s.ReadManifest(id, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Crash once the manifest of b is written but before it is recorded, and
+	// before the manifest of c is written at all
+	idx := s.loadIndex()
+	if err := idx.prepare(s.fileInfo(id, "b", m), chunkHashes(m)); err != nil {
+		t.Fatal(err)
+	}
+	f, err := s.openFileForWriting(id, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := *m
+	record.Key = "b"
+	if err := s.finishWrite(f, json.NewEncoder(f).Encode(&record)); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.prepare(s.fileInfo(id, "c", m), chunkHashes(m)); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := NewStore(opts)
+	for key, want := range map[string]bool{"a": true, "b": true, "c": false} {
+		if _, err := reopened.Stat(id, key); (err == nil) != want {
+			t.Errorf("%s: have %v want indexed %v", key, err, want)
+		}
+	}
+
+	// A change that can't be logged doesn't show in memory either
+	if _, err := reopened.Write(id, "d", bytes.NewReader([]byte("more bytes"))); err != nil {
+		t.Fatal(err)
+	}
+	reopened.loadIndex().log.Close()
+	if err := reopened.loadIndex().remove(id, "d"); err == nil {
+		t.Fatal("removal logged to a closed file")
+	}
+	if _, err := reopened.Stat(id, "d"); err != nil {
+		t.Errorf("have %v after a failed removal want d still indexed", err)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	keyringVersion = 1        // Current keyring file format
+	keyringHash    = "sha256" // Hash filing data keys in new keyrings
+	keySize        = 32       // AES-256 keys throughout
+
+	// scrypt parameters deriving the key that protects the master key
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var (
+	// ErrWrongPassphrase is returned when a keyring can't be unlocked
+	ErrWrongPassphrase = errors.New("wrong keyring passphrase")
+	// ErrNoDataKey is returned when the keyring has no key for a file
+	ErrNoDataKey = errors.New("no data key for file")
+)
+
+// keyringFile is the on-disk form of a keyring. Data keys and the
+// convergence secret are wrapped by the master key, the master key by a key
+// derived from the passphrase.
+type keyringFile struct {
+	Version     int               // Keyring file format
+	Salt        []byte            // scrypt salt
+	Master      []byte            // Wrapped master key
+	Secret      []byte            // Wrapped secret deriving chunk keys
+	Hash        string            // Names the hash of file keys that data keys are filed by
+	Keys        map[string][]byte // Wrapped data keys by the hash of the file key
+	Generations map[string]int    `json:",omitempty"` // Times a file's data key was replaced
+}
+
+// Keyring holds a data key per file, wrapped by a master key and persisted,
+// so a restarted node can still decrypt what it stored on peers
+type Keyring struct {
+	path string // Keyring file, empty for a keyring kept in memory only
+
+	lock   sync.Mutex
+	file   keyringFile
+	hash   HashFunc // Files data keys, as named in file
+	kek    []byte // Key derived from the passphrase, nil in memory
+	master []byte // Unwrapped master key
+	secret []byte // Unwrapped convergence secret
+}
+
+// NewKeyring creates a keyring that only lives in memory, files it encrypts
+// can't be decrypted after a restart
+func NewKeyring() *Keyring {
+	k := &Keyring{
+		file:   keyringFile{Version: keyringVersion, Hash: keyringHash, Keys: make(map[string][]byte)},
+		hash:   hashFuncs[keyringHash],
+		master: newEncryptionKey(),
+		secret: newEncryptionKey(),
+	}
+	k.file.Secret, _ = wrapKey(k.master, k.secret, "secret")
+	return k
+}
+
+// OpenKeyring unlocks the keyring at path with passphrase, creating it if
+// it doesn't exist yet
+func OpenKeyring(path string, passphrase string) (*Keyring, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return createKeyring(path, passphrase)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	k := &Keyring{path: path}
+	if err := json.Unmarshal(b, &k.file); err != nil {
+		return nil, fmt.Errorf("keyring %s: %w", path, err)
+	}
+	if k.file.Version != keyringVersion {
+		return nil, fmt.Errorf("keyring %s: unsupported version %d", path, k.file.Version)
+	}
+	if k.hash, err = HashFuncByName(k.file.Hash); err != nil {
+		return nil, fmt.Errorf("keyring %s: %w", path, err)
+	}
+	if k.file.Keys == nil {
+		k.file.Keys = make(map[string][]byte)
+	}
+
+	if k.kek, err = passphraseKey(passphrase, k.file.Salt); err != nil {
+		return nil, err
+	}
+	if k.master, err = unwrapKey(k.kek, k.file.Master, "master"); err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	if k.secret, err = unwrapKey(k.master, k.file.Secret, "secret"); err != nil {
+		return nil, fmt.Errorf("keyring %s: %w", path, err)
+	}
+
+	return k, nil
+}
+
+// createKeyring writes a new keyring with a fresh master key
+func createKeyring(path string, passphrase string) (*Keyring, error) {
+	k := NewKeyring()
+	k.path = path
+
+	k.file.Salt = make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, k.file.Salt); err != nil {
+		return nil, err
+	}
+	var err error
+	if k.kek, err = passphraseKey(passphrase, k.file.Salt); err != nil {
+		return nil, err
+	}
+	if k.file.Master, err = wrapKey(k.kek, k.master, "master"); err != nil {
+		return nil, err
+	}
+
+	return k, k.save()
+}
+
+// DataKey returns the data key of a file
+func (k *Keyring) DataKey(key string) ([]byte, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	id := k.dataKeyID(key)
+	wrapped, ok := k.file.Keys[id]
+	if !ok {
+		return nil, ErrNoDataKey
+	}
+	return unwrapKey(k.master, wrapped, id)
+}
+
+// CreateDataKey returns the data key of a file, generating and persisting
+// one if the file has none yet
+func (k *Keyring) CreateDataKey(key string) ([]byte, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	id := k.dataKeyID(key)
+	if wrapped, ok := k.file.Keys[id]; ok {
+		return unwrapKey(k.master, wrapped, id)
+	}
+
+	dataKey := newEncryptionKey()
+	wrapped, err := wrapKey(k.master, dataKey, id)
+	if err != nil {
+		return nil, err
+	}
+	k.file.Keys[id] = wrapped
+
+	return dataKey, k.save()
+}
+
+// ReplaceDataKey gives a file whose data key was compromised a new one. The
+// file's chunk keys change with it, so its chunks must be encrypted again.
+func (k *Keyring) ReplaceDataKey(key string) ([]byte, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	id := k.dataKeyID(key)
+	dataKey := newEncryptionKey()
+	wrapped, err := wrapKey(k.master, dataKey, id)
+	if err != nil {
+		return nil, err
+	}
+	k.file.Keys[id] = wrapped
+	if k.file.Generations == nil {
+		k.file.Generations = make(map[string]int)
+	}
+	k.file.Generations[id]++
+
+	return dataKey, k.save()
+}
+
+// RotateMaster wraps every key under a new master key
+func (k *Keyring) RotateMaster() error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	master := newEncryptionKey()
+	file := k.file
+	file.Keys = make(map[string][]byte, len(k.file.Keys))
+	for id, wrapped := range k.file.Keys {
+		dataKey, err := unwrapKey(k.master, wrapped, id)
+		if err != nil {
+			return fmt.Errorf("data key %s: %w", id, err)
+		}
+		if file.Keys[id], err = wrapKey(master, dataKey, id); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if file.Secret, err = wrapKey(master, k.secret, "secret"); err != nil {
+		return err
+	}
+	if k.kek != nil {
+		if file.Master, err = wrapKey(k.kek, master, "master"); err != nil {
+			return err
+		}
+	}
+
+	// Only switch to the new master once it's on disk, the keys in the old
+	// file stay wrapped under the old one
+	old := k.file
+	k.file = file
+	if err := k.save(); err != nil {
+		k.file = old
+		return err
+	}
+	k.master = master
+	return nil
+}
+
+// RotateSecret replaces the convergence secret, which changes the chunk keys
+// of every file. Files encrypted before have to be encrypted again, the
+// chunk keys sealed in their manifests still decrypt them meanwhile.
+func (k *Keyring) RotateSecret() error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	secret := newEncryptionKey()
+	file := k.file
+	var err error
+	if file.Secret, err = wrapKey(k.master, secret, "secret"); err != nil {
+		return err
+	}
+
+	old := k.file
+	k.file = file
+	if err := k.save(); err != nil {
+		k.file = old
+		return err
+	}
+	k.secret = secret
+	return nil
+}
+
+// chunkKey derives the key a chunk of a file is encrypted with from the hash
+// of its plaintext. Identical chunks get the same key, so they deduplicate
+// across files on peers while only nodes holding the secret can derive the
+// keys. Files whose data key was replaced use keys of their own.
+func (k *Keyring) chunkKey(key string, hash string) []byte {
+	k.lock.Lock()
+	id := k.dataKeyID(key)
+	generation := k.file.Generations[id]
+	secret := k.secret
+	k.lock.Unlock()
+
+	mac := hmac.New(sha256.New, secret)
+	if generation > 0 {
+		fmt.Fprintf(mac, "%s/%d/", id, generation)
+	}
+	mac.Write([]byte(hash))
+	return mac.Sum(nil)
+}
+
+// keyEpoch identifies the chunk keys of a file without revealing them. It
+// changes whenever they do, when the secret rotates or the file's data key
+// is replaced.
+func (k *Keyring) keyEpoch(key string) string {
+	k.lock.Lock()
+	id := k.dataKeyID(key)
+	generation := k.file.Generations[id]
+	secret := k.secret
+	k.lock.Unlock()
+
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "epoch/%s/%d", id, generation)
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// dataKeyID returns the ID a file's data key is filed under, the hash of
+// its key
+func (k *Keyring) dataKeyID(key string) string {
+	return k.hash([]byte(key))
+}
+
+// save persists the keyring
+func (k *Keyring) save() error {
+	if len(k.path) == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(&k.file)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(k.path, b)
+}
+
+// passphraseKey derives the key protecting the master key
+func passphraseKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, keySize)
+}
+
+// wrapKey encrypts key under kek, binding it to label
+func wrapKey(kek []byte, key []byte, label string) ([]byte, error) {
+	aead, err := newKeyWrapAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, key, []byte(label)), nil
+}
+
+// unwrapKey decrypts a key wrapped with wrapKey
+func unwrapKey(kek []byte, wrapped []byte, label string) ([]byte, error) {
+	aead, err := newKeyWrapAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrAuthentication
+	}
+
+	key, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(label))
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	return key, nil
+}
+
+func newKeyWrapAEAD(kek []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyringPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+
+	k, err := OpenKeyring(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := k.CreateDataKey("a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := k.CreateDataKey("b.png")
+	if bytes.Equal(a, b) {
+		t.Error("files share a data key")
+	}
+	if _, err := k.DataKey("c.png"); err != ErrNoDataKey {
+		t.Errorf("have %v want %v", err, ErrNoDataKey)
+	}
+
+	// A restarted node finds the same keys
+	reopened, err := OpenKeyring(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := reopened.DataKey("a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, a) {
+		t.Error("data key changed after reopening")
+	}
+	if !bytes.Equal(reopened.chunkKey("a.png", "chunk"), k.chunkKey("a.png", "chunk")) {
+		t.Error("chunk keys changed after reopening")
+	}
+
+	if _, err := OpenKeyring(path, "guess"); err != ErrWrongPassphrase {
+		t.Errorf("have %v want %v", err, ErrWrongPassphrase)
+	}
+}
+
+func TestKeyringRotateMasterKeepsOldMasterOnFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	k, err := OpenKeyring(filepath.Join(dir, "keyring.json"), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey, err := k.CreateDataKey("a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new master can't be saved, so the keyring keeps using the old one
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.RotateMaster(); err == nil {
+		t.Fatal("rotated the master key without saving it")
+	}
+	have, err := k.DataKey("a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, dataKey) {
+		t.Error("data key changed after a failed rotation")
+	}
+}
+
+func TestKeyringFilesKeysByItsHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	k, err := OpenKeyring(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A keyring keeps filing keys by the hash it was created with
+	k.file.Hash, k.hash = "blake3", BLAKE3Hash
+	dataKey, err := k.CreateDataKey("a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenKeyring(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reopened.file.Keys[BLAKE3Hash([]byte("a.png"))]; !ok {
+		t.Error("data key not filed by the keyring's hash")
+	}
+	if have, err := reopened.DataKey("a.png"); err != nil || !bytes.Equal(have, dataKey) {
+		t.Errorf("have %v want the data key", err)
+	}
+
+	k.file.Hash = "crc"
+	if err := k.save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenKeyring(path, "secret"); err == nil {
+		t.Error("opened a keyring with an unknown hash")
+	}
+}
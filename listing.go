@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultListLimit = 100  // Files per page when no limit is given
+	maxListLimit     = 1000 // Largest page a node answers with
+)
+
+// ReplicaInfo describes the copy of a file one node holds
+type ReplicaInfo struct {
+	Node    string    // Node holding the copy
+	Size    int64     // Bytes stored
+	Digest  string    // Identifies the stored contents, equal for equal copies
+	Created time.Time // When the origin stored the file
+}
+
+// NetworkFile describes a file and the copies of it found on the network
+type NetworkFile struct {
+	Owner     string        // Node that stored the file
+	Key       string        // Network key
+	Name      string        // Key the file was stored under, only its owner knows it
+	Replicas  []ReplicaInfo // Copies found, the owner's own included
+	Placement []string      // Nodes the ring assigns copies to
+}
+
+// FilePage is one page of a network-wide listing
+type FilePage struct {
+	Files       []NetworkFile // Sorted by network key
+	Next        string        // Cursor of the next page, empty on the last one
+	Unreachable int           // Nodes that didn't answer, copies they hold are missing
+}
+
+// MessageListFiles asks a node for the files of an owner it holds
+type MessageListFiles struct {
+	ID     string // Owner node ID
+	Prefix string // Only network keys starting with it
+	After  string // Only network keys sorted after it
+	Limit  int    // Most files to return
+}
+
+// MessageListFilesResponse answers MessageListFiles
+type MessageListFilesResponse struct {
+	Files []NetworkFile // Sorted by key, each with the responder's copy
+	More  bool          // Further files follow the last one
+}
+
+// MessageStatFile asks a node whether it holds a file
+type MessageStatFile struct {
+	ID  string // Owner node ID
+	Key string // Network key
+}
+
+// MessageStatFileResponse answers MessageStatFile
+type MessageStatFileResponse struct {
+	Found bool        // Responder holds the file
+	File  NetworkFile // With the responder's copy
+}
+
+// listLimit bounds the requested page size
+func listLimit(limit int) int {
+	if limit <= 0 {
+		return defaultListLimit
+	}
+	if limit > maxListLimit {
+		return maxListLimit
+	}
+	return limit
+}
+
+// heldFile describes a local file by the key the network knows it under
+func (s *FileServer) heldFile(owner string, info FileInfo) NetworkFile {
+	f := NetworkFile{
+		Owner: owner,
+		Key:   info.Key,
+		Replicas: []ReplicaInfo{{
+			Node:    s.ID,
+			Size:    info.Size,
+			Digest:  info.Digest,
+			Created: info.Created,
+		}},
+	}
+	if owner == s.ID {
+		// Our own files are stored under their plain keys
+		f.Key, f.Name = s.hashKey(info.Key), info.Key
+	}
+	return f
+}
+
+// heldFiles lists the files of owner this node holds, sorted by network key,
+// and reports whether more than limit matched
+func (s *FileServer) heldFiles(owner string, prefix string, after string, limit int) ([]NetworkFile, bool) {
+	files := []NetworkFile{}
+	for _, info := range s.store.List(owner, "") {
+		f := s.heldFile(owner, info)
+		if strings.HasPrefix(f.Key, prefix) && f.Key > after {
+			files = append(files, f)
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Key < files[j].Key })
+	if len(files) > limit {
+		return files[:limit], true
+	}
+	return files, false
+}
+
+// heldCopy returns this node's copy of the file with the given network key
+func (s *FileServer) heldCopy(owner string, key string) (NetworkFile, bool) {
+	if owner != s.ID {
+		info, err := s.store.Stat(owner, key)
+		if err != nil {
+			return NetworkFile{}, false
+		}
+		return s.heldFile(owner, info), true
+	}
+
+	for _, info := range s.store.List(owner, "") {
+		if s.hashKey(info.Key) == key {
+			return s.heldFile(owner, info), true
+		}
+	}
+	return NetworkFile{}, false
+}
+
+// fileMerger combines the copies of files reported by several nodes
+type fileMerger struct {
+	lock  sync.Mutex
+	files map[string]*NetworkFile // By network key
+}
+
+// add records the files one node reported
+func (m *fileMerger) add(files []NetworkFile) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.files == nil {
+		m.files = make(map[string]*NetworkFile)
+	}
+	for _, f := range files {
+		merged, ok := m.files[f.Key]
+		if !ok {
+			f := f
+			f.Replicas = append([]ReplicaInfo{}, f.Replicas...)
+			m.files[f.Key] = &f
+			continue
+		}
+		merged.Replicas = append(merged.Replicas, f.Replicas...)
+		if len(f.Name) > 0 {
+			merged.Name = f.Name
+		}
+	}
+}
+
+// sorted returns the merged files ordered by network key, with their
+// replicas ordered by node and the nodes the ring places them on
+func (m *fileMerger) sorted(ring *hashRing, replication int) []NetworkFile {
+	files := make([]NetworkFile, 0, len(m.files))
+	for _, f := range m.files {
+		sort.Slice(f.Replicas, func(i, j int) bool { return f.Replicas[i].Node < f.Replicas[j].Node })
+		f.Placement = ring.owners(f.Key, replication, f.Owner)
+		files = append(files, *f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Key < files[j].Key })
+	return files
+}
+
+// ListFiles lists the files owner stored on the network a page of up to
+// limit at a time, with the copies of each file found and the nodes the ring
+// places it on. Files are named by network key, prefix filters those and
+// cursor is the Next of the previous page, empty for the first. Every known
+// node is asked, so the copies are counted exactly among those answering.
+func (s *FileServer) ListFiles(ctx context.Context, owner string, prefix string, cursor string, limit int) (*FilePage, error) {
+	limit = listLimit(limit)
+	query := MessageListFiles{ID: owner, Prefix: prefix, After: cursor, Limit: limit}
+
+	// Every node sends its first limit keys, which includes its copies of
+	// the first limit keys overall
+	merger := &fileMerger{}
+	local, more := s.heldFiles(owner, prefix, cursor, limit)
+	merger.add(local)
+
+	page := &FilePage{}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range s.rt.all() {
+		wg.Add(1)
+		go func(c Contact) {
+			defer wg.Done()
+
+			reply, err := s.callContact(ctx, c, query)
+			if err == nil {
+				res, ok := reply.Payload.(MessageListFilesResponse)
+				if ok {
+					merger.add(res.Files)
+					lock.Lock()
+					more = more || res.More
+					lock.Unlock()
+					return
+				}
+				err = fmt.Errorf("unexpected reply %T", reply.Payload)
+			}
+
+			log.Printf("[%s] listing files on %s failed: %s", s.Transport.Addr(), c.ID, err)
+			lock.Lock()
+			page.Unreachable++
+			lock.Unlock()
+		}(c)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	page.Files = merger.sorted(s.ring, s.ReplicationFactor)
+	if len(page.Files) > limit {
+		page.Files, more = page.Files[:limit], true
+	}
+	if more && len(page.Files) > 0 {
+		page.Next = page.Files[len(page.Files)-1].Key
+	}
+	return page, nil
+}
+
+// StatFile reports where the copies of a file this node stored live. The
+// DHT is asked for the nodes holding it, along with those the ring places it
+// on. It returns ErrNotFound when no copy is left.
+func (s *FileServer) StatFile(ctx context.Context, key string) (*NetworkFile, error) {
+	hashedKey := s.hashKey(key)
+	query := MessageStatFile{ID: s.ID, Key: hashedKey}
+
+	merger := &fileMerger{}
+	merger.add([]NetworkFile{{Owner: s.ID, Key: hashedKey, Name: key}})
+	if f, ok := s.heldCopy(s.ID, hashedKey); ok {
+		merger.add([]NetworkFile{f})
+	}
+
+	_, holders := s.lookup(ctx, keyNodeID(hashedKey), &MessageFindValue{ID: s.ID, Key: hashedKey})
+	targets := map[string]Contact{}
+	for _, c := range holders {
+		targets[c.ID] = c
+	}
+	for _, id := range s.ring.owners(hashedKey, s.ReplicationFactor, s.ID) {
+		if c, ok := s.rt.contact(id); ok {
+			targets[id] = c
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range targets {
+		wg.Add(1)
+		go func(c Contact) {
+			defer wg.Done()
+
+			reply, err := s.callContact(ctx, c, query)
+			if err != nil {
+				log.Printf("[%s] stat of (%s) on %s failed: %s", s.Transport.Addr(), hashedKey, c.ID, err)
+				return
+			}
+			if res, ok := reply.Payload.(MessageStatFileResponse); ok && res.Found {
+				merger.add([]NetworkFile{res.File})
+			}
+		}(c)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	file := merger.sorted(s.ring, s.ReplicationFactor)[0]
+	if len(file.Replicas) == 0 {
+		return nil, ErrNotFound
+	}
+	return &file, nil
+}
+
+// handleMessageListFiles answers with the files of an owner this node holds
+func (s *FileServer) handleMessageListFiles(from string, id uint64, msg MessageListFiles) error {
+	files, more := s.heldFiles(msg.ID, msg.Prefix, msg.After, listLimit(msg.Limit))
+	return s.respond(from, id, MessageListFilesResponse{Files: files, More: more})
+}
+
+// handleMessageStatFile answers whether this node holds a file
+func (s *FileServer) handleMessageStatFile(from string, id uint64, msg MessageStatFile) error {
+	f, ok := s.heldCopy(msg.ID, msg.Key)
+	return s.respond(from, id, MessageStatFileResponse{Found: ok, File: f})
+}
+
+func init() {
+	gob.Register(MessageListFiles{})
+	gob.Register(MessageListFilesResponse{})
+	gob.Register(MessageStatFile{})
+	gob.Register(MessageStatFileResponse{})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestListFiles(t *testing.T) {
+	s := NewFileServer(FileServerOpts{
+		StorageRoot:       filepath.Join(t.TempDir(), "store"),
+		PathTransformFunc: CASPathTransformFunc,
+		Transport:         stubTransport{},
+	})
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		if err := s.Store(fmt.Sprintf("file_%d", i), bytes.NewReader([]byte("contents"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bob := generateID()
+	if _, err := s.store.Write(bob, "00ff", bytes.NewReader([]byte("bob's ciphertext"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Page through our own files
+	keys := []string{}
+	for cursor, pages := "", 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("pagination doesn't end")
+		}
+		page, err := s.ListFiles(ctx, s.ID, "", cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Files) > 2 {
+			t.Errorf("have %d files on a page of 2", len(page.Files))
+		}
+		for _, f := range page.Files {
+			if f.Key != s.hashKey(f.Name) || len(f.Replicas) != 1 || f.Replicas[0].Node != s.ID {
+				t.Errorf("have %+v", f)
+			}
+			keys = append(keys, f.Key)
+		}
+		if cursor = page.Next; len(cursor) == 0 {
+			break
+		}
+	}
+	if len(keys) != 5 {
+		t.Errorf("have %d files listed want 5", len(keys))
+	}
+	for i := 1; i < len(keys); i++ {
+		if keys[i-1] >= keys[i] {
+			t.Errorf("keys out of order: %v", keys)
+		}
+	}
+
+	page, err := s.ListFiles(ctx, s.ID, keys[0][:8], "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Files) != 1 || page.Files[0].Key != keys[0] {
+		t.Errorf("have %+v want the file with prefix %s", page.Files, keys[0][:8])
+	}
+
+	// Replicas held for others are listed under their network keys
+	page, _ = s.ListFiles(ctx, bob, "", "", 0)
+	if len(page.Files) != 1 || page.Files[0].Key != "00ff" || len(page.Files[0].Name) != 0 {
+		t.Errorf("have %+v want bob's replica", page.Files)
+	}
+
+	file, err := s.StatFile(ctx, "file_3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Name != "file_3" || len(file.Replicas) != 1 {
+		t.Errorf("have %+v", file)
+	}
+	if _, err := s.StatFile(ctx, "never stored"); err != ErrNotFound {
+		t.Errorf("have %v want %v", err, ErrNotFound)
+	}
+}
+
+func TestFileMerger(t *testing.T) {
+	m := &fileMerger{}
+	m.add([]NetworkFile{{Owner: "alice", Key: "k", Replicas: []ReplicaInfo{{Node: "node_b"}}}})
+	m.add([]NetworkFile{{Owner: "alice", Key: "k", Name: "notes.txt", Replicas: []ReplicaInfo{{Node: "node_a"}}}})
+	m.add([]NetworkFile{{Owner: "alice", Key: "j", Replicas: []ReplicaInfo{{Node: "node_a"}}}})
+
+	files := m.sorted(newHashRing(), 3)
+	if len(files) != 2 || files[0].Key != "j" || files[1].Key != "k" {
+		t.Fatalf("have %+v", files)
+	}
+	if have := files[1]; have.Name != "notes.txt" || len(have.Replicas) != 2 || have.Replicas[0].Node != "node_a" {
+		t.Errorf("have %+v want both copies of notes.txt", have)
+	}
+}
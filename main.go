@@ -2,36 +2,72 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/utkarshgupta2804/p2p-filestorage/p2p"
 )
 
+// demoPassphrase protects the keyrings of a -demo run without a passphrase.
+// It is public, so it protects nothing.
+const demoPassphrase = "p2p-filestorage demo"
+
 // sanitizeAddr removes invalid characters from address for use as directory name
 func sanitizeAddr(addr string) string {
 	// Remove colon and replace with underscore for Windows compatibility
 	return strings.ReplaceAll(addr, ":", "")
 }
 
+// keyringPassphrase returns the passphrase unlocking the keyrings, taken from
+// KEYRING_PASSPHRASE. Only a demo run falls back to the demo passphrase.
+func keyringPassphrase(demo bool) (string, error) {
+	if passphrase := os.Getenv("KEYRING_PASSPHRASE"); len(passphrase) > 0 {
+		return passphrase, nil
+	}
+	if !demo {
+		return "", errors.New("KEYRING_PASSPHRASE is not set, set it or pass -demo to use the public demo passphrase")
+	}
+	log.Println("WARNING: KEYRING_PASSPHRASE is not set, keyrings are only protected by the public demo passphrase")
+	return demoPassphrase, nil
+}
+
 // makeServer creates and configures a FileServer instance for P2P file sharing.
+// passphrase: Unlocks the node's keyring
 // listenAddr: The address this server will listen on
 // nodes: Bootstrap nodes to connect to initially
-func makeServer(listenAddr string, nodes ...string) *FileServer {
+func makeServer(passphrase string, listenAddr string, nodes ...string) *FileServer {
+	// Load the node key pair, created on first start and reused afterwards
+	identity, err := p2p.LoadIdentity(sanitizeAddr(listenAddr) + "_identity.key")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Unlock the keyring holding per-file encryption keys
+	keyring, err := OpenKeyring(sanitizeAddr(listenAddr)+"_keyring.json", passphrase)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Configure TCP transport options
 	tcptransportOpts := p2p.TCPTransportOpts{
-		ListenAddr:    listenAddr,           // Address to listen on
-		HandshakeFunc: p2p.NOPHandshakeFunc, // No-op handshake function
-		Decoder:       p2p.DefaultDecoder{}, // Default message decoder
+		ListenAddr:    listenAddr,                           // Address to listen on
+		HandshakeFunc: p2p.IdentityHandshakeFunc(identity), // Signed identity exchange
+		Decoder:       p2p.DefaultDecoder{},                 // Default message decoder
+		Identity:      identity,                             // Key pair securing sessions
+		Encrypt:       true,                                 // Mutually authenticated TLS 1.3
 	}
 	tcpTransport := p2p.NewTCPTransport(tcptransportOpts)
 
 	// Configure FileServer options
 	fileServerOpts := FileServerOpts{
-		EncKey:            newEncryptionKey(),                           // Generate encryption key for secure transfers
+		Identity:          identity,                                     // Persistent node identity
+		Keyring:           keyring,                                      // Per-file keys, persisted across restarts
 		StorageRoot:       sanitizeAddr(listenAddr) + "_network",        // Storage directory based on listen address (Windows-safe)
 		PathTransformFunc: CASPathTransformFunc,                         // Content-addressable storage path function
 		Transport:         tcpTransport,                                 // Network transport layer
@@ -43,18 +79,34 @@ func makeServer(listenAddr string, nodes ...string) *FileServer {
 
 	// Assign OnPeer callback to handle new peer connections
 	tcpTransport.OnPeer = s.OnPeer
+	tcpTransport.OnPeerDisconnect = s.OnPeerDisconnect // Forget peers whose connection is gone
 
 	return s
 }
 
 func main() {
+	// Rewrite a storage root of an earlier release to the current layout
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	demo := flag.Bool("demo", false, "Use the public demo passphrase when KEYRING_PASSPHRASE is not set")
+	flag.Parse()
+	passphrase, err := keyringPassphrase(*demo)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Create three FileServer instances:
 	// s1 - First node with no bootstrap nodes
 	// s2 - Second node with no bootstrap nodes
 	// s3 - Third node that connects to s1 and s2
-	s1 := makeServer(":3000", "")
-	s2 := makeServer(":7000", "")
-	s3 := makeServer(":5000", ":3000", ":7000")
+	s1 := makeServer(passphrase, ":3000", "")
+	s2 := makeServer(passphrase, ":7000", "")
+	s3 := makeServer(passphrase, ":5000", ":3000", ":7000")
 
 	// Start s1 and s2 concurrently
 	go func() { log.Fatal(s1.Start()) }()
@@ -94,4 +146,12 @@ func main() {
 
 		fmt.Println(string(b)) // Print the file contents
 	}
+
+	// Delete a file from the whole network, replicas included
+	if err := s3.Delete("picture_0.png"); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := s3.Get("picture_0.png"); err == ErrDeleted {
+		fmt.Println("picture_0.png is gone from the network")
+	}
 }
\ No newline at end of file
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// MigrationReport summarises a storage root migration
+type MigrationReport struct {
+	Files      int      // Files moved to the new layout
+	Renamed    int      // Replicated files of them renamed to the new key hash
+	Chunks     int      // Chunks moved to the new fan-out
+	Unresolved []string // Files left in place because their key is unknown
+}
+
+// MigrateStore rewrites the storage root of opts from the layout written by
+// the from path transform to the one opts describes. Files record their key
+// since this release, for older ones keys lists the keys to look for, and
+// files stored before chunking are split into chunks on the way. Each file is
+// written under the new layout before the old one is removed and files whose
+// key can't be found are left in place and reported, so nothing is lost and
+// an interrupted migration can simply be run again.
+//
+// Files replicated from other nodes are stored under the name the network
+// knows them by, their key hashed with fromKeyHash in the old release. Those
+// whose key is listed are renamed to the keyHash of it, the name their
+// origins look them up by now.
+func MigrateStore(opts StoreOpts, from PathTransformFunc, fromKeyHash HashFunc, keyHash HashFunc, keys []string) (*MigrationReport, error) {
+	s := NewStore(opts)
+	report := &MigrationReport{}
+
+	if err := s.migrateChunks(report); err != nil {
+		return report, err
+	}
+
+	entries, err := os.ReadDir(s.Root)
+	if err != nil {
+		return report, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() || e.Name() == chunkFolderName {
+			continue
+		}
+		if err := s.migrateFiles(e.Name(), from, fromKeyHash, keyHash, keys, report); err != nil {
+			return report, err
+		}
+	}
+
+	// Files moved under the index, record where they are now
+	s.loadIndex()
+	return report, s.rebuildIndex()
+}
+
+// migrateChunks moves chunks to the directories the store's fan-out puts them
+func (s *Store) migrateChunks(report *MigrationReport) error {
+	chunkRoot := filepath.Join(s.Root, chunkFolderName)
+	paths, err := listFiles(chunkRoot)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		hash := filepath.Base(path)
+		if !validChunkHash(hash) {
+			continue // Not a chunk, leave it alone
+		}
+		target := filepath.Clean(s.chunkPath(hash))
+		if path == target {
+			continue
+		}
+
+		if s.hasChunk(hash) {
+			// Chunks are named by their contents, the copy in place is the same
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		} else {
+			if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+				return err
+			}
+			if err := os.Rename(path, target); err != nil {
+				return err
+			}
+		}
+		report.Chunks++
+	}
+
+	return removeEmptyDirs(chunkRoot)
+}
+
+// migrateFiles moves the files stored for id to the store's path transform,
+// renaming replicated files whose key is known to the new key hash
+func (s *Store) migrateFiles(id string, from PathTransformFunc, fromKeyHash HashFunc, keyHash HashFunc, keys []string, report *MigrationReport) error {
+	dir := filepath.Join(s.Root, id)
+	candidates := map[string]string{} // New key by old path
+	replicas := map[string]bool{}     // Old paths of replicated files
+	renames := map[string]string{}    // New network name by old one
+	for _, key := range keys {
+		candidates[filepath.Join(dir, filepath.FromSlash(from(key).FullPath()))] = key
+
+		old, renamed := fromKeyHash([]byte(key)), keyHash([]byte(key))
+		path := filepath.Join(dir, filepath.FromSlash(from(old).FullPath()))
+		candidates[path], replicas[path] = renamed, true
+		renames[old] = renamed
+	}
+
+	paths, err := listFiles(dir)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		m, isManifest := parseManifest(path)
+
+		key := candidates[path]
+		if isManifest && len(m.Key) > 0 {
+			key = m.Key
+			if renamed, ok := renames[m.Key]; ok {
+				key = renamed
+			}
+		}
+		if len(key) == 0 {
+			report.Unresolved = append(report.Unresolved, path)
+			continue
+		}
+		if path == filepath.Clean(s.manifestPath(id, key)) {
+			continue
+		}
+
+		if isManifest {
+			err = s.writeManifest(id, key, m)
+		} else {
+			err = s.importFile(id, key, path)
+		}
+		if err != nil {
+			return fmt.Errorf("migrating %s: %w", path, err)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+
+		// Renamed replicas are only indexed under their new name
+		renamed := replicas[path]
+		if isManifest && len(m.Key) > 0 {
+			if renamed = m.Key != key; renamed {
+				if err := s.loadIndex().remove(id, m.Key); err != nil {
+					return err
+				}
+			}
+		}
+		if renamed {
+			report.Renamed++
+		}
+		report.Files++
+	}
+
+	return removeEmptyDirs(dir)
+}
+
+// importFile stores a file written before files were split into chunks
+func (s *Store) importFile(id string, key string, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = s.Write(id, key, f)
+	return err
+}
+
+// parseManifest reads the file at path if it is a manifest. Files stored
+// before chunking hold their contents instead, which rarely decode as a
+// manifest and never without unknown fields.
+func parseManifest(path string) (*Manifest, bool) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+
+	m := &Manifest{}
+	if err := dec.Decode(m); err != nil || dec.More() {
+		return nil, false
+	}
+	return m, true
+}
+
+// listFiles returns the paths of all regular files under dir
+func listFiles(dir string) ([]string, error) {
+	paths := []string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// removeEmptyDirs removes the directories under dir left empty
+func removeEmptyDirs(dir string) error {
+	dirs := []string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path != dir {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Deepest first, so parents are empty by the time they're reached
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, path := range dirs {
+		os.Remove(path) // Fails on directories that still hold files
+	}
+	return nil
+}
+
+// runMigrate is the migrate command, moving a storage root to a new layout
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	root := flags.String("root", "", "storage root to migrate")
+	fromHash := flags.String("from-hash", "sha1", "hash naming files in the old layout")
+	fromDepth := flags.Int("from-depth", 8, "directory levels of the old layout")
+	fromWidth := flags.Int("from-width", 5, "characters per directory of the old layout")
+	hash := flags.String("hash", "sha256", "hash naming files in the new layout")
+	fromKeyHash := flags.String("from-key-hash", "md5", "hash naming replicated files on the network in the old release")
+	keyHash := flags.String("key-hash", "sha256", "hash naming replicated files on the network now")
+	depth := flags.Int("depth", defaultFanOutDepth, "directory levels of the new layout")
+	width := flags.Int("width", defaultFanOutWidth, "characters per directory of the new layout")
+	keysFile := flags.String("keys", "", "file listing keys of files that don't record theirs, one per line")
+	flags.Parse(args)
+
+	if len(*root) == 0 {
+		return errors.New("migrate: -root is required")
+	}
+	from, err := HashFuncByName(*fromHash)
+	if err != nil {
+		return err
+	}
+	to, err := HashFuncByName(*hash)
+	if err != nil {
+		return err
+	}
+	fromNames, err := HashFuncByName(*fromKeyHash)
+	if err != nil {
+		return err
+	}
+	names, err := HashFuncByName(*keyHash)
+	if err != nil {
+		return err
+	}
+	keys, err := readKeys(*keysFile)
+	if err != nil {
+		return err
+	}
+
+	opts := StoreOpts{Root: *root, Hash: to, FanOutDepth: *depth, FanOutWidth: *width}
+	report, err := MigrateStore(opts, NewCASPathTransformFunc(from, *fromDepth, *fromWidth), fromNames, names, keys)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("migrated %d files, %d of them renamed, and %d chunks in %s\n", report.Files, report.Renamed, report.Chunks, *root)
+	for _, path := range report.Unresolved {
+		fmt.Printf("left in place, key unknown: %s\n", path)
+	}
+	return nil
+}
+
+// readKeys reads a file listing one key per line
+func readKeys(path string) ([]string, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if key := strings.TrimSpace(scanner.Text()); len(key) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	return keys, scanner.Err()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateStore(t *testing.T) {
+	root := t.TempDir()
+	id := generateID()
+
+	// A root written by an earlier release: SHA-1 paths, chunks one level deep
+	old := NewStore(StoreOpts{Root: root, PathTransformFunc: LegacyPathTransformFunc, FanOutDepth: 1})
+	if _, err := old.Write(id, "chunked.txt", bytes.NewReader([]byte("chunked contents"))); err != nil {
+		t.Fatal(err)
+	}
+	// Replicas other nodes stored here under the MD5 the network named them by
+	origin := generateID()
+	if _, err := old.Write(origin, MD5Hash([]byte("notes.txt")), bytes.NewReader([]byte("chunked replica"))); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		filepath.Join(id, LegacyPathTransformFunc("plain.txt").FullPath()):                       "stored before chunking",
+		filepath.Join(id, LegacyPathTransformFunc("lost.txt").FullPath()):                        "nobody knows my key",
+		filepath.Join(origin, LegacyPathTransformFunc(MD5Hash([]byte("shared.txt"))).FullPath()): "someone else's file",
+	}
+	for name, data := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := StoreOpts{Root: root, Hash: BLAKE3Hash}
+	keys := []string{"plain.txt", "shared.txt", "notes.txt"}
+	report, err := MigrateStore(opts, LegacyPathTransformFunc, MD5Hash, SHA256Hash, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Files != 4 || report.Renamed != 2 || report.Chunks != 2 || len(report.Unresolved) != 1 {
+		t.Errorf("have report %+v want 4 files, 2 renamed, 2 chunks and 1 unresolved", report)
+	}
+
+	s := NewStore(opts)
+	for key, want := range map[string]string{"chunked.txt": "chunked contents", "plain.txt": "stored before chunking"} {
+		_, r, err := s.Read(id, key)
+		if err != nil {
+			t.Fatalf("%s: %s", key, err)
+		}
+		b, _ := ioutil.ReadAll(r)
+		if string(b) != want {
+			t.Errorf("%s: have %q want %q", key, b, want)
+		}
+	}
+
+	// Replicas are found under the name their origin looks them up by now
+	for key, want := range map[string]string{"shared.txt": "someone else's file", "notes.txt": "chunked replica"} {
+		renamed := SHA256Hash([]byte(key))
+		if _, r, err := s.Read(origin, renamed); err != nil {
+			t.Fatalf("%s: %s", key, err)
+		} else if b, _ := ioutil.ReadAll(r); string(b) != want {
+			t.Errorf("%s: have replica %q want %q", key, b, want)
+		}
+		if _, err := s.Stat(origin, renamed); err != nil {
+			t.Errorf("%s: renamed replica not indexed: %s", key, err)
+		}
+		if _, err := s.Stat(origin, MD5Hash([]byte(key))); err == nil {
+			t.Errorf("%s: still indexed under its old name", key)
+		}
+	}
+
+	// Files without a known key stay where they were
+	if b, err := os.ReadFile(report.Unresolved[0]); err != nil || string(b) != "nobody knows my key" {
+		t.Errorf("unresolved file lost: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, id, LegacyPathTransformFunc("plain.txt").FirstPathName())); !os.IsNotExist(err) {
+		t.Error("old directories left behind")
+	}
+
+	// Running it again finds nothing left to move
+	report, err = MigrateStore(opts, LegacyPathTransformFunc, MD5Hash, SHA256Hash, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Files != 0 || report.Chunks != 0 {
+		t.Errorf("have report %+v on a migrated root want nothing moved", report)
+	}
+}
@@ -0,0 +1,36 @@
+package p2p
+
+import "time"
+
+// Clock tells the time and runs the timers of a transport, so a simulation
+// can run heartbeats on virtual time
+type Clock interface {
+    Now() time.Time                 // Current time
+    NewTimer(d time.Duration) Timer // Timer firing once d passed
+}
+
+// Timer fires once by sending the time on its channel, like time.Timer
+type Timer interface {
+    C() <-chan time.Time // Receives the time when the timer fires
+    Stop() bool          // Stop the timer, false if it already fired or stopped
+}
+
+// systemClock is the Clock of real time
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+    return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+    return systemTimer{time.NewTimer(d)}
+}
+
+// systemTimer is a Timer of real time
+type systemTimer struct {
+    *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+    return t.Timer.C
+}
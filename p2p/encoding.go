@@ -1,46 +1,77 @@
 package p2p
 
 import (
+    "encoding/binary"
     "encoding/gob"
+    "errors"
     "io"
 )
 
-// Decoder decodes messages from a reader
+// frameHeaderSize is the size of the type byte, uint32 stream ID and uint32 payload length
+const frameHeaderSize = 9
+
+// MaxPayloadSize is the largest payload a single frame may carry
+const MaxPayloadSize = 16 << 20 // 16MB
+
+// ErrPayloadTooLarge is returned when a frame exceeds MaxPayloadSize
+var ErrPayloadTooLarge = errors.New("p2p: frame payload too large")
+
+// Decoder decodes frames from a reader
 type Decoder interface {
-    Decode(io.Reader, *RPC) error
+    Decode(io.Reader, *Frame) error
+}
+
+// Encoder encodes frames onto a writer
+type Encoder interface {
+    Encode(io.Writer, *Frame) error
 }
 
 // GOBDecoder uses gob encoding
 type GOBDecoder struct{}
 
-func (dec GOBDecoder) Decode(r io.Reader, msg *RPC) error {
-    return gob.NewDecoder(r).Decode(msg)
+func (dec GOBDecoder) Decode(r io.Reader, f *Frame) error {
+    return gob.NewDecoder(r).Decode(f)
 }
 
-// DefaultDecoder handles simple message formats
+// DefaultDecoder reads length-prefixed frames: type byte, uint32 stream ID, uint32 length, payload
 type DefaultDecoder struct{}
 
-func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
-    peekBuf := make([]byte, 1)
-    if _, err := r.Read(peekBuf); err != nil {
-        return nil
+func (dec DefaultDecoder) Decode(r io.Reader, f *Frame) error {
+    var hdr [frameHeaderSize]byte
+    if _, err := io.ReadFull(r, hdr[:]); err != nil {
+        return err
     }
 
-    // Check if this is a stream
-    stream := peekBuf[0] == IncomingStream
-    if stream {
-        msg.Stream = true
-        return nil
+    size := binary.BigEndian.Uint32(hdr[5:])
+    if size > MaxPayloadSize {
+        return ErrPayloadTooLarge
     }
 
-    // Read regular message
-    buf := make([]byte, 1028)
-    n, err := r.Read(buf)
-    if err != nil {
+    f.Type = hdr[0]
+    f.StreamID = binary.BigEndian.Uint32(hdr[1:5])
+    f.Payload = make([]byte, size)
+    if _, err := io.ReadFull(r, f.Payload); err != nil {
         return err
     }
 
-    msg.Payload = buf[:n]
-
     return nil
-}
\ No newline at end of file
+}
+
+// DefaultEncoder writes frames in the format read by DefaultDecoder
+type DefaultEncoder struct{}
+
+func (enc DefaultEncoder) Encode(w io.Writer, f *Frame) error {
+    if len(f.Payload) > MaxPayloadSize {
+        return ErrPayloadTooLarge
+    }
+
+    // Write header and payload in one call so concurrent frames don't interleave
+    buf := make([]byte, frameHeaderSize+len(f.Payload))
+    buf[0] = f.Type
+    binary.BigEndian.PutUint32(buf[1:5], f.StreamID)
+    binary.BigEndian.PutUint32(buf[5:], uint32(len(f.Payload)))
+    copy(buf[frameHeaderSize:], f.Payload)
+
+    _, err := w.Write(buf)
+    return err
+}
@@ -0,0 +1,46 @@
+package p2p
+
+import (
+	"bytes"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameEncodeDecode(t *testing.T) {
+	var (
+		buf   = new(bytes.Buffer)
+		enc   = DefaultEncoder{}
+		large = bytes.Repeat([]byte("metadata"), 4096)
+	)
+
+	assert.Nil(t, enc.Encode(buf, &Frame{Type: IncomingMessage, Payload: large}))
+	assert.Nil(t, enc.Encode(buf, &Frame{Type: IncomingStream, StreamID: 7}))
+	assert.Nil(t, enc.Encode(buf, &Frame{Type: StreamData, StreamID: 7, Payload: []byte("small")}))
+
+	// Deliver one byte per read to simulate a payload split across segments
+	r := iotest.OneByteReader(buf)
+	dec := DefaultDecoder{}
+
+	f := Frame{}
+	assert.Nil(t, dec.Decode(r, &f))
+	assert.Equal(t, byte(IncomingMessage), f.Type)
+	assert.Equal(t, large, f.Payload)
+
+	f = Frame{}
+	assert.Nil(t, dec.Decode(r, &f))
+	assert.Equal(t, byte(IncomingStream), f.Type)
+	assert.Equal(t, uint32(7), f.StreamID)
+	assert.Empty(t, f.Payload)
+
+	f = Frame{}
+	assert.Nil(t, dec.Decode(r, &f))
+	assert.Equal(t, []byte("small"), f.Payload)
+}
+
+func TestFrameDecodeTooLarge(t *testing.T) {
+	hdr := []byte{IncomingMessage, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}
+	f := Frame{}
+	assert.Equal(t, ErrPayloadTooLarge, DefaultDecoder{}.Decode(bytes.NewReader(hdr), &f))
+}
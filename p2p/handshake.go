@@ -1,7 +1,122 @@
 package p2p
 
-// HandshakeFunc performs a handshake with a peer
-type HandshakeFunc func(Peer) error
+import (
+    "bytes"
+    "crypto/ed25519"
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "io"
+    "net"
+    "time"
+)
+
+const (
+    handshakeTimeout = 10 * time.Second   // Upper bound for completing a handshake
+    handshakeContext = "p2p-handshake-v1" // Domain separation for handshake signatures
+    nonceSize        = 32
+)
+
+var (
+    // ErrBadSignature is returned when the remote fails to prove its identity
+    ErrBadSignature = errors.New("p2p: handshake signature verification failed")
+    // ErrSelfConnection is returned when a node connects to itself
+    ErrSelfConnection = errors.New("p2p: connected to self")
+)
+
+// HandshakeFunc performs a handshake over a newly established connection.
+// It returns the verified ID of the remote node, or an empty string when the
+// handshake does not authenticate peers.
+type HandshakeFunc func(conn net.Conn, outbound bool) (string, error)
 
 // NOPHandshakeFunc is a no-operation handshake
-func NOPHandshakeFunc(Peer) error { return nil }
\ No newline at end of file
+func NOPHandshakeFunc(net.Conn, bool) (string, error) { return "", nil }
+
+// IdentityHandshakeFunc returns a handshake in which both sides exchange
+// their public keys and a fresh nonce, then sign the transcript to prove
+// they own the key. The dialer speaks first so the exchange also works on
+// unbuffered connections:
+//
+//  dialer   -> listener: pubkey, nonce
+//  listener -> dialer:   pubkey, nonce, signature
+//  dialer   -> listener: signature
+func IdentityHandshakeFunc(id *Identity) HandshakeFunc {
+    return func(conn net.Conn, outbound bool) (string, error) {
+        conn.SetDeadline(time.Now().Add(handshakeTimeout))
+        defer conn.SetDeadline(time.Time{})
+
+        localHello := make([]byte, ed25519.PublicKeySize+nonceSize)
+        copy(localHello, id.PublicKey())
+        if _, err := io.ReadFull(rand.Reader, localHello[ed25519.PublicKeySize:]); err != nil {
+            return "", err
+        }
+        remoteHello := make([]byte, len(localHello))
+        remoteSig := make([]byte, ed25519.SignatureSize)
+
+        var dialerHello, listenerHello []byte
+        if outbound {
+            dialerHello, listenerHello = localHello, remoteHello
+
+            if _, err := conn.Write(localHello); err != nil {
+                return "", err
+            }
+            if _, err := io.ReadFull(conn, remoteHello); err != nil {
+                return "", err
+            }
+            if _, err := io.ReadFull(conn, remoteSig); err != nil {
+                return "", err
+            }
+        } else {
+            dialerHello, listenerHello = remoteHello, localHello
+
+            if _, err := io.ReadFull(conn, remoteHello); err != nil {
+                return "", err
+            }
+        }
+
+        remoteKey := ed25519.PublicKey(remoteHello[:ed25519.PublicKeySize])
+        if bytes.Equal(remoteKey, id.PublicKey()) {
+            return "", ErrSelfConnection
+        }
+
+        // Each side signs both hellos plus its role, so a signature can't be
+        // replayed on another connection or reflected back at its sender
+        localSig := id.Sign(handshakeTranscript(outbound, dialerHello, listenerHello))
+
+        if outbound {
+            if !ed25519.Verify(remoteKey, handshakeTranscript(false, dialerHello, listenerHello), remoteSig) {
+                return "", ErrBadSignature
+            }
+            if _, err := conn.Write(localSig); err != nil {
+                return "", err
+            }
+        } else {
+            if _, err := conn.Write(append(localHello, localSig...)); err != nil {
+                return "", err
+            }
+            if _, err := io.ReadFull(conn, remoteSig); err != nil {
+                return "", err
+            }
+            if !ed25519.Verify(remoteKey, handshakeTranscript(true, dialerHello, listenerHello), remoteSig) {
+                return "", ErrBadSignature
+            }
+        }
+
+        return hex.EncodeToString(remoteKey), nil
+    }
+}
+
+// handshakeTranscript builds the message signed by the dialer or listener
+func handshakeTranscript(dialer bool, dialerHello, listenerHello []byte) []byte {
+    role := []byte("listener")
+    if dialer {
+        role = []byte("dialer")
+    }
+
+    buf := new(bytes.Buffer)
+    buf.WriteString(handshakeContext)
+    buf.Write(role)
+    buf.Write(dialerHello)
+    buf.Write(listenerHello)
+    return buf.Bytes()
+}
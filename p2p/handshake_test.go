@@ -0,0 +1,64 @@
+package p2p
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentityHandshake(t *testing.T) {
+	dialer, err := NewIdentity()
+	assert.Nil(t, err)
+	listener, err := NewIdentity()
+	assert.Nil(t, err)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	errch := make(chan error, 1)
+	go func() {
+		id, err := IdentityHandshakeFunc(listener)(c2, false)
+		assert.Equal(t, dialer.ID(), id)
+		errch <- err
+	}()
+
+	id, err := IdentityHandshakeFunc(dialer)(c1, true)
+	assert.Nil(t, err)
+	assert.Equal(t, listener.ID(), id)
+	assert.Nil(t, <-errch)
+}
+
+func TestIdentityHandshakeSelf(t *testing.T) {
+	self, err := NewIdentity()
+	assert.Nil(t, err)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	// The transport closes the connection when a handshake fails
+	go func() {
+		_, err := IdentityHandshakeFunc(self)(c2, false)
+		assert.Equal(t, ErrSelfConnection, err)
+		c2.Close()
+	}()
+
+	_, err = IdentityHandshakeFunc(self)(c1, true)
+	assert.NotNil(t, err)
+}
+
+func TestLoadIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+
+	first, err := LoadIdentity(path)
+	assert.Nil(t, err)
+	second, err := LoadIdentity(path)
+	assert.Nil(t, err)
+	assert.Equal(t, first.ID(), second.ID())
+
+	sig := first.Sign([]byte("hello"))
+	assert.True(t, VerifyID(second.ID(), []byte("hello"), sig))
+}
@@ -0,0 +1,200 @@
+package p2p
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+)
+
+const (
+    DefaultHeartbeatInterval = 15 * time.Second // Time between heartbeats when none is configured
+    DefaultHeartbeatMisses   = 3                // Heartbeats left unanswered in a row before a peer is dropped
+    rttSmoothing             = 8                // Weight of the history in the smoothed round trip, as TCP's SRTT
+)
+
+// ErrPeerUnresponsive is the reason a peer that stopped answering heartbeats is dropped
+var ErrPeerUnresponsive = errors.New("p2p: peer stopped answering heartbeats")
+
+// PeerStats describes the health of a peer connection
+type PeerStats struct {
+    RTT         time.Duration // Round trip of the last answered heartbeat, zero before the first
+    SmoothedRTT time.Duration // Moving average of the round trips
+    LastSeen    time.Time     // When the peer last sent anything
+    Missed      int           // Heartbeats left unanswered in a row
+}
+
+// liveness tracks the heartbeats of a session
+type liveness struct {
+    lock     sync.Mutex
+    stats    PeerStats
+    seq      uint64               // Sequence number of the last heartbeat sent
+    pending  map[uint64]time.Time // Send times of unanswered heartbeats by sequence number
+    answered bool                 // A heartbeat was answered since the last one was sent
+    pong     []byte               // Payload of the latest ping not answered yet
+    ponging  bool                 // A goroutine is writing pongs
+}
+
+// stats returns the health of the session
+func (s *session) stats() PeerStats {
+    s.live.lock.Lock()
+    defer s.live.lock.Unlock()
+    return s.live.stats
+}
+
+// seen records that the remote sent something
+func (s *session) seen() {
+    s.live.lock.Lock()
+    s.live.stats.LastSeen = s.clock.Now()
+    s.live.lock.Unlock()
+}
+
+// ping counts the previous heartbeat as missed when it went unanswered and
+// sends the next. It returns the heartbeats missed in a row, and
+// ErrPeerUnresponsive without sending anything once they reach misses.
+func (s *session) ping(misses int) (int, error) {
+    l := &s.live
+    l.lock.Lock()
+    if l.seq > 0 && !l.answered {
+        l.stats.Missed++
+    }
+    if l.stats.Missed >= misses {
+        missed := l.stats.Missed
+        l.lock.Unlock()
+        return missed, ErrPeerUnresponsive
+    }
+    l.answered = false
+    l.seq++
+    seq, missed := l.seq, l.stats.Missed
+
+    // Heartbeats older than the threshold won't be waited for anymore
+    l.pending[seq] = s.clock.Now()
+    delete(l.pending, seq-uint64(misses))
+    l.lock.Unlock()
+
+    buf := make([]byte, 8)
+    binary.BigEndian.PutUint64(buf, seq)
+    return missed, s.writeFrame(&Frame{Type: Ping, Payload: buf})
+}
+
+// handlePing answers a heartbeat. The pong is written aside from the read
+// loop so two peers pinging each other over an unbuffered connection
+// can't block on one another. Only the latest ping waits for an answer, so
+// a peer flooding pings can't pile up writers.
+func (s *session) handlePing(payload []byte) error {
+    if len(payload) != 8 {
+        return fmt.Errorf("p2p: malformed ping of %d bytes", len(payload))
+    }
+
+    l := &s.live
+    l.lock.Lock()
+    l.pong = payload
+    start := !l.ponging
+    l.ponging = true
+    l.lock.Unlock()
+
+    if start {
+        go s.writePongs()
+    }
+    return nil
+}
+
+// writePongs answers pings until none is waiting
+func (s *session) writePongs() {
+    l := &s.live
+    for {
+        l.lock.Lock()
+        payload := l.pong
+        l.pong = nil
+        if payload == nil {
+            l.ponging = false
+            l.lock.Unlock()
+            return
+        }
+        l.lock.Unlock()
+
+        s.writeFrame(&Frame{Type: Pong, Payload: payload})
+    }
+}
+
+// handlePong records the round trip of an answered heartbeat
+func (s *session) handlePong(payload []byte) error {
+    if len(payload) != 8 {
+        return fmt.Errorf("p2p: malformed pong of %d bytes", len(payload))
+    }
+    seq := binary.BigEndian.Uint64(payload)
+
+    l := &s.live
+    l.lock.Lock()
+    defer l.lock.Unlock()
+
+    sent, ok := l.pending[seq]
+    if !ok {
+        return nil // Answers a heartbeat given up on
+    }
+    delete(l.pending, seq)
+
+    rtt := s.clock.Now().Sub(sent)
+    l.stats.RTT = rtt
+    if l.stats.SmoothedRTT == 0 {
+        l.stats.SmoothedRTT = rtt
+    } else {
+        l.stats.SmoothedRTT += (rtt - l.stats.SmoothedRTT) / rttSmoothing
+    }
+    l.stats.Missed = 0
+    l.answered = true
+    return nil
+}
+
+// heartbeat pings the peer every interval until its connection closes, and
+// drops it once misses heartbeats in a row went unanswered. A half-open
+// connection is noticed that way even while nothing is written to it.
+func (t *TCPTransport) heartbeat(peer *TCPPeer) {
+    interval, misses := t.heartbeatOpts()
+    if interval < 0 {
+        return
+    }
+
+    for {
+        timer := t.Clock.NewTimer(interval)
+        select {
+        case <-timer.C():
+        case <-peer.session.closed:
+            timer.Stop()
+            return
+        }
+
+        if missed, err := peer.session.ping(misses); err != nil {
+            log.Printf("dropping peer %s after %d missed heartbeats: %s", peer.ID(), missed, err)
+            peer.Close()
+            return
+        }
+    }
+}
+
+// heartbeatOpts returns the heartbeat interval and misses with defaults
+// applied, the interval is negative when heartbeats are off
+func (t *TCPTransport) heartbeatOpts() (time.Duration, int) {
+    interval, misses := t.HeartbeatInterval, t.HeartbeatMisses
+    if interval == 0 {
+        interval = DefaultHeartbeatInterval
+    }
+    if misses <= 0 {
+        misses = DefaultHeartbeatMisses
+    }
+    return interval, misses
+}
+
+// writeTimeout returns how long a frame may take to write, as long as a
+// peer may go without answering heartbeats. A peer that stopped reading is
+// dropped that way even while a write to it is stuck. Zero when heartbeats
+// are off.
+func (t *TCPTransport) writeTimeout() time.Duration {
+    interval, misses := t.heartbeatOpts()
+    if interval < 0 {
+        return 0
+    }
+    return interval * time.Duration(misses)
+}
@@ -0,0 +1,85 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeartbeatMeasuresRTT(t *testing.T) {
+	opts := TCPTransportOpts{ListenAddr: "127.0.0.1:0", HeartbeatInterval: 10 * time.Millisecond}
+	a := NewTCPTransport(opts)
+	assert.Nil(t, a.ListenAndAccept())
+	t.Cleanup(func() { a.Close() })
+
+	b := NewTCPTransport(opts)
+	p, err := b.Dial(a.listener.Addr().String())
+	assert.Nil(t, err)
+	defer p.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Stats().RTT == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no heartbeat answered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	stats := p.Stats()
+	assert.True(t, stats.SmoothedRTT > 0)
+	assert.Equal(t, 0, stats.Missed)
+	assert.False(t, stats.LastSeen.IsZero())
+}
+
+func TestHeartbeatDropsUnresponsivePeer(t *testing.T) {
+	gone := make(chan Peer, 1)
+	a := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:        "127.0.0.1:0",
+		HeartbeatInterval: 10 * time.Millisecond,
+		HeartbeatMisses:   2,
+		OnPeerDisconnect:  func(p Peer) { gone <- p },
+	})
+	assert.Nil(t, a.ListenAndAccept())
+	t.Cleanup(func() { a.Close() })
+
+	// A half-open connection: it stays up but nothing answers
+	conn, err := net.Dial("tcp", a.listener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	select {
+	case p := <-gone:
+		assert.Equal(t, conn.LocalAddr().String(), p.RemoteAddr().String())
+		assert.True(t, p.Stats().Missed >= 2)
+	case <-time.After(5 * time.Second):
+		t.Fatal("unresponsive peer kept")
+	}
+}
+
+func TestHeartbeatDropsPeerThatStoppedReading(t *testing.T) {
+	network := NewMemoryNetwork()
+	gone := make(chan Peer, 1)
+	a := NewMemoryTransport(network, TCPTransportOpts{
+		ListenAddr:        "a:3000",
+		HeartbeatInterval: 10 * time.Millisecond,
+		HeartbeatMisses:   2,
+		OnPeerDisconnect:  func(p Peer) { gone <- p },
+	})
+	assert.Nil(t, a.ListenAndAccept())
+	t.Cleanup(func() { a.Close() })
+
+	// Pipes don't buffer, so the first heartbeat to a peer that never reads
+	// blocks its writer
+	conn, err := network.dial("b:3000", "a:3000")
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	select {
+	case p := <-gone:
+		assert.Equal(t, "b:3000", p.RemoteAddr().String())
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer stuck on a write kept")
+	}
+}
@@ -0,0 +1,85 @@
+package p2p
+
+import (
+    "crypto/ed25519"
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "os"
+    "strings"
+)
+
+// Identity is the persistent Ed25519 key pair of a node
+type Identity struct {
+    PrivateKey ed25519.PrivateKey
+}
+
+// NewIdentity generates a fresh random identity
+func NewIdentity() (*Identity, error) {
+    _, priv, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+    return &Identity{PrivateKey: priv}, nil
+}
+
+// LoadIdentity reads the identity stored at path, creating and persisting a
+// new one if the file does not exist yet
+func LoadIdentity(path string) (*Identity, error) {
+    b, err := os.ReadFile(path)
+    if errors.Is(err, os.ErrNotExist) {
+        id, err := NewIdentity()
+        if err != nil {
+            return nil, err
+        }
+        seed := hex.EncodeToString(id.PrivateKey.Seed())
+        if err := os.WriteFile(path, []byte(seed+"\n"), 0600); err != nil {
+            return nil, err
+        }
+        return id, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+    if err != nil || len(seed) != ed25519.SeedSize {
+        return nil, fmt.Errorf("p2p: malformed identity file %s", path)
+    }
+
+    return &Identity{PrivateKey: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// PublicKey returns the public half of the key pair
+func (i *Identity) PublicKey() ed25519.PublicKey {
+    return i.PrivateKey.Public().(ed25519.PublicKey)
+}
+
+// ID returns the node ID, the hex encoded public key
+func (i *Identity) ID() string {
+    return hex.EncodeToString(i.PublicKey())
+}
+
+// Sign signs msg with the identity's private key
+func (i *Identity) Sign(msg []byte) []byte {
+    return ed25519.Sign(i.PrivateKey, msg)
+}
+
+// PublicKeyFromID decodes the public key embedded in a node ID
+func PublicKeyFromID(id string) (ed25519.PublicKey, error) {
+    b, err := hex.DecodeString(id)
+    if err != nil || len(b) != ed25519.PublicKeySize {
+        return nil, fmt.Errorf("p2p: invalid node id %q", id)
+    }
+    return ed25519.PublicKey(b), nil
+}
+
+// VerifyID checks that sig is a valid signature of msg by the node with the given ID
+func VerifyID(id string, msg, sig []byte) bool {
+    pub, err := PublicKeyFromID(id)
+    if err != nil {
+        return false
+    }
+    return ed25519.Verify(pub, msg, sig)
+}
@@ -0,0 +1,145 @@
+package p2p
+
+import (
+    "fmt"
+    "net"
+    "sync"
+)
+
+// MemoryNetwork connects the MemoryTransports created on it through
+// in-memory pipes, so nodes of a test can talk without opening ports
+type MemoryNetwork struct {
+    lock      sync.Mutex
+    listeners map[string]*memoryListener // By listen address
+}
+
+// NewMemoryNetwork creates an empty in-memory network
+func NewMemoryNetwork() *MemoryNetwork {
+    return &MemoryNetwork{listeners: make(map[string]*memoryListener)}
+}
+
+// MemoryTransport is a Transport whose connections are net.Pipe pairs on a
+// MemoryNetwork. Only making connections differs from TCPTransport, the
+// handshake, encryption, streams and heartbeats are the same.
+type MemoryTransport struct {
+    *TCPTransport
+}
+
+// NewMemoryTransport creates a transport on network. Its ListenAddr only
+// needs to be unique within the network, and should look like host:port
+// since nodes exchange it as their dialable address.
+func NewMemoryTransport(network *MemoryNetwork, opts TCPTransportOpts) *MemoryTransport {
+    t := NewTCPTransport(opts)
+    t.listen = network.listen
+    t.dial = func(addr string) (net.Conn, error) {
+        return network.dial(t.ListenAddr, addr)
+    }
+    return &MemoryTransport{TCPTransport: t}
+}
+
+// listen registers a listener at addr
+func (n *MemoryNetwork) listen(addr string) (net.Listener, error) {
+    n.lock.Lock()
+    defer n.lock.Unlock()
+
+    if _, ok := n.listeners[addr]; ok {
+        return nil, fmt.Errorf("p2p: memory address %s already in use", addr)
+    }
+    l := newMemoryListener(addr, func() {
+        n.lock.Lock()
+        delete(n.listeners, addr)
+        n.lock.Unlock()
+    })
+    n.listeners[addr] = l
+    return l, nil
+}
+
+// dial connects from to the listener at addr
+func (n *MemoryNetwork) dial(from string, addr string) (net.Conn, error) {
+    n.lock.Lock()
+    l, ok := n.listeners[addr]
+    n.lock.Unlock()
+    if !ok {
+        return nil, fmt.Errorf("p2p: dial memory %s: connection refused", addr)
+    }
+
+    local, remote := net.Pipe()
+    if err := l.deliver(&memoryConn{Conn: remote, local: memoryAddr(addr), remote: memoryAddr(from)}); err != nil {
+        local.Close()
+        return nil, err
+    }
+    return &memoryConn{Conn: local, local: memoryAddr(from), remote: memoryAddr(addr)}, nil
+}
+
+// memoryAddr is the address of a MemoryTransport
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return "memory" }
+func (a memoryAddr) String() string  { return string(a) }
+
+// memoryConn is one end of a pipe, reporting the addresses of the
+// transports it connects
+type memoryConn struct {
+    net.Conn
+    local  net.Addr
+    remote net.Addr
+}
+
+func (c *memoryConn) LocalAddr() net.Addr  { return c.local }
+func (c *memoryConn) RemoteAddr() net.Addr { return c.remote }
+
+// memoryListener hands out the connections dialed to its address
+type memoryListener struct {
+    addr    memoryAddr
+    conns   chan net.Conn // Connections waiting to be accepted
+    release func()        // Frees the address
+
+    closeOnce sync.Once
+    closed    chan struct{}
+}
+
+// newMemoryListener creates a listener at addr calling release once closed
+func newMemoryListener(addr string, release func()) *memoryListener {
+    return &memoryListener{
+        addr:    memoryAddr(addr),
+        conns:   make(chan net.Conn),
+        release: release,
+        closed:  make(chan struct{}),
+    }
+}
+
+// deliver hands a dialed connection to Accept, closing it when the
+// listener closed first
+func (l *memoryListener) deliver(conn net.Conn) error {
+    select {
+    case l.conns <- conn:
+        return nil
+    case <-l.closed:
+        conn.Close()
+        return fmt.Errorf("p2p: dial %s %s: connection refused", l.addr.Network(), l.addr)
+    }
+}
+
+// Accept waits for the next connection
+func (l *memoryListener) Accept() (net.Conn, error) {
+    select {
+    case conn := <-l.conns:
+        return conn, nil
+    case <-l.closed:
+        return nil, net.ErrClosed
+    }
+}
+
+// Close stops accepting connections and frees the address
+func (l *memoryListener) Close() error {
+    l.closeOnce.Do(func() {
+        close(l.closed)
+        l.release()
+    })
+    return nil
+}
+
+// Addr returns the listen address
+func (l *memoryListener) Addr() net.Addr {
+    return l.addr
+}
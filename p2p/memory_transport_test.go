@@ -0,0 +1,73 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newMemoryTransport starts an encrypted transport on network
+func newMemoryTransport(t *testing.T, network *MemoryNetwork, addr string, peerch chan<- Peer) (*MemoryTransport, *Identity) {
+	id, err := NewIdentity()
+	assert.Nil(t, err)
+
+	tr := NewMemoryTransport(network, TCPTransportOpts{
+		ListenAddr:    addr,
+		HandshakeFunc: IdentityHandshakeFunc(id),
+		Identity:      id,
+		Encrypt:       true,
+		OnPeer: func(p Peer) error {
+			peerch <- p
+			return nil
+		},
+	})
+	assert.Nil(t, tr.ListenAndAccept())
+	t.Cleanup(func() { tr.Close() })
+
+	return tr, id
+}
+
+func TestMemoryTransport(t *testing.T) {
+	t.Parallel()
+
+	var (
+		network = NewMemoryNetwork()
+		peersA  = make(chan Peer, 1)
+		peersB  = make(chan Peer, 1)
+	)
+	a, idA := newMemoryTransport(t, network, "alice:1", peersA)
+	b, idB := newMemoryTransport(t, network, "bob:1", peersB)
+
+	pb, err := b.Dial("alice:1")
+	assert.Nil(t, err)
+	assert.Equal(t, idA.ID(), pb.ID())
+	assert.Equal(t, "alice:1", pb.RemoteAddr().String())
+	<-peersB
+
+	var pa Peer
+	select {
+	case pa = <-peersA:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for inbound peer")
+	}
+	assert.Equal(t, idB.ID(), pa.ID())
+	assert.Equal(t, "bob:1", pa.RemoteAddr().String())
+
+	assert.Nil(t, pb.Send([]byte("over a pipe")))
+	rpc := <-a.Consume()
+	assert.Equal(t, idB.ID(), rpc.From)
+	assert.Equal(t, []byte("over a pipe"), rpc.Payload)
+
+	// Unknown and closed addresses refuse connections, and closing frees
+	// the address
+	_, err = b.Dial("carol:1")
+	assert.NotNil(t, err)
+	assert.Nil(t, a.Close())
+	_, err = b.Dial("alice:1")
+	assert.NotNil(t, err)
+	_, err = network.listen("alice:1")
+	assert.Nil(t, err)
+	_, err = network.listen("alice:1")
+	assert.NotNil(t, err)
+}
@@ -1,13 +1,26 @@
 package p2p
 
 const (
-    IncomingMessage = 0x1 // Regular message
-    IncomingStream  = 0x2 // Stream message
+    IncomingMessage = 0x1 // Frame type of a regular message
+    IncomingStream  = 0x2 // Frame type opening a stream, payload is the stream header
+    StreamData      = 0x3 // Frame type carrying stream data
+    StreamWindow    = 0x4 // Frame type granting send window back to the remote
+    StreamClose     = 0x5 // Frame type half-closing a stream
+    StreamReset     = 0x6 // Frame type aborting a stream
+    Ping            = 0x7 // Frame type of a heartbeat, payload is its sequence number
+    Pong            = 0x8 // Frame type answering a heartbeat with its payload
 )
 
+// Frame is a single unit on the wire
+type Frame struct {
+    Type     byte   // Frame type
+    StreamID uint32 // Logical stream, zero for regular messages
+    Payload  []byte // Frame content
+}
+
 // RPC represents a remote procedure call
 type RPC struct {
-    From    string // Sender address
-    Payload []byte // Message content
-    Stream  bool   // Whether this is a stream
-}
\ No newline at end of file
+    From    string // Sender node ID
+    Payload []byte // Message content or stream header
+    Stream  Stream // Stream opened by the sender, nil for regular messages
+}
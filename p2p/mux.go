@@ -0,0 +1,416 @@
+package p2p
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "sync"
+    "time"
+)
+
+const (
+    initialStreamWindow = 256 << 10 // Bytes a peer may send on a stream before a window update
+    maxDataFrameSize    = 32 << 10  // Largest data frame written by a stream
+)
+
+var (
+    // ErrSessionClosed is returned when the underlying connection is gone
+    ErrSessionClosed = errors.New("p2p: session closed")
+    // ErrStreamClosed is returned when writing to a half-closed stream
+    ErrStreamClosed = errors.New("p2p: stream closed")
+    // ErrStreamReset is returned when a stream was aborted by either side
+    ErrStreamReset = errors.New("p2p: stream reset")
+)
+
+// Stream is a logical bidirectional stream multiplexed over a peer connection.
+// Close half-closes the stream for writing; Reset aborts it in both directions.
+type Stream interface {
+    io.ReadWriteCloser
+    ID() uint32   // Stream identifier, unique per connection
+    Reset() error // Abort the stream
+}
+
+// session multiplexes streams and regular messages over a single connection
+type session struct {
+    conn    net.Conn
+    encoder Encoder
+
+    writeLock    sync.Mutex    // Serialises frames on the connection
+    writeTimeout time.Duration // Longest a frame may take to write, no limit when zero
+
+    streamLock sync.Mutex         // Protects streams and nextID
+    streams    map[uint32]*stream // Open streams by ID
+    nextID     uint32             // Next locally initiated stream ID
+
+    live  liveness // Heartbeats and round trips
+    clock Clock    // Times heartbeats and round trips
+
+    closeOnce sync.Once
+    closed    chan struct{}
+}
+
+// newSession creates a session over conn. The dialing side uses odd stream
+// IDs and the accepting side even ones, so both can open streams without
+// coordination.
+func newSession(conn net.Conn, outbound bool, encoder Encoder) *session {
+    nextID := uint32(2)
+    if outbound {
+        nextID = 1
+    }
+    return &session{
+        conn:    conn,
+        encoder: encoder,
+        streams: make(map[uint32]*stream),
+        nextID:  nextID,
+        live:    liveness{pending: make(map[uint64]time.Time)},
+        clock:   systemClock{},
+        closed:  make(chan struct{}),
+    }
+}
+
+// writeFrame encodes a single frame onto the connection
+func (s *session) writeFrame(f *Frame) error {
+    s.writeLock.Lock()
+    defer s.writeLock.Unlock()
+
+    select {
+    case <-s.closed:
+        return ErrSessionClosed
+    default:
+    }
+
+    if s.writeTimeout > 0 {
+        s.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+    }
+    if err := s.encoder.Encode(s.conn, f); err != nil {
+        // A frame cut short leaves the connection out of sync, and a write
+        // that timed out means the remote stopped reading
+        s.conn.Close()
+        return err
+    }
+    return nil
+}
+
+// send writes a regular message
+func (s *session) send(b []byte) error {
+    return s.writeFrame(&Frame{Type: IncomingMessage, Payload: b})
+}
+
+// openStream opens a new stream, sending header along with the open frame
+func (s *session) openStream(header []byte) (*stream, error) {
+    s.streamLock.Lock()
+    id := s.nextID
+    s.nextID += 2
+    st := newStream(s, id)
+    s.streams[id] = st
+    s.streamLock.Unlock()
+
+    if err := s.writeFrame(&Frame{Type: IncomingStream, StreamID: id, Payload: header}); err != nil {
+        s.removeStream(id)
+        return nil, err
+    }
+
+    return st, nil
+}
+
+// getStream looks up an open stream
+func (s *session) getStream(id uint32) *stream {
+    s.streamLock.Lock()
+    defer s.streamLock.Unlock()
+    return s.streams[id]
+}
+
+// removeStream forgets a stream once both sides are done with it
+func (s *session) removeStream(id uint32) {
+    s.streamLock.Lock()
+    defer s.streamLock.Unlock()
+    delete(s.streams, id)
+}
+
+// handleFrame applies an incoming frame to the session. It returns an RPC
+// when the frame is a message or opens a stream that must be delivered to the
+// consumer, and nil otherwise.
+func (s *session) handleFrame(f *Frame) (*RPC, error) {
+    switch f.Type {
+    case IncomingMessage:
+        return &RPC{Payload: f.Payload}, nil
+
+    case IncomingStream:
+        s.streamLock.Lock()
+        if _, ok := s.streams[f.StreamID]; ok || f.StreamID%2 == s.nextID%2 {
+            s.streamLock.Unlock()
+            return nil, fmt.Errorf("p2p: invalid stream id %d opened by remote", f.StreamID)
+        }
+        st := newStream(s, f.StreamID)
+        s.streams[f.StreamID] = st
+        s.streamLock.Unlock()
+        return &RPC{Payload: f.Payload, Stream: st}, nil
+
+    case StreamData:
+        if st := s.getStream(f.StreamID); st != nil {
+            st.pushData(f.Payload)
+        }
+
+    case StreamWindow:
+        if len(f.Payload) != 4 {
+            return nil, fmt.Errorf("p2p: malformed window update on stream %d", f.StreamID)
+        }
+        if st := s.getStream(f.StreamID); st != nil {
+            st.grantWindow(binary.BigEndian.Uint32(f.Payload))
+        }
+
+    case StreamClose:
+        if st := s.getStream(f.StreamID); st != nil {
+            st.remoteClose()
+        }
+
+    case StreamReset:
+        if st := s.getStream(f.StreamID); st != nil {
+            st.abort(ErrStreamReset)
+        }
+
+    case Ping:
+        return nil, s.handlePing(f.Payload)
+
+    case Pong:
+        return nil, s.handlePong(f.Payload)
+
+    default:
+        return nil, fmt.Errorf("p2p: unknown frame type 0x%x", f.Type)
+    }
+
+    return nil, nil
+}
+
+// close tears down the session and fails every open stream
+func (s *session) close() {
+    s.closeOnce.Do(func() {
+        close(s.closed)
+
+        s.streamLock.Lock()
+        streams := make([]*stream, 0, len(s.streams))
+        for _, st := range s.streams {
+            streams = append(streams, st)
+        }
+        s.streamLock.Unlock()
+
+        for _, st := range streams {
+            st.abort(ErrSessionClosed)
+        }
+    })
+}
+
+// stream is a single logical stream within a session
+type stream struct {
+    id   uint32
+    sess *session
+
+    lock       sync.Mutex
+    recvBuf    bytes.Buffer // Data received but not yet read
+    unacked    uint32       // Bytes read but not yet granted back to the remote
+    sendWindow uint32       // Bytes we may still send before a window update
+    localFin   bool         // We half-closed the stream
+    remoteFin  bool         // The remote half-closed the stream
+    err        error        // Set once the stream is reset or the session closes
+
+    recvNotify chan struct{} // Signalled when data arrives or state changes
+    sendNotify chan struct{} // Signalled when send window opens or state changes
+}
+
+func newStream(sess *session, id uint32) *stream {
+    return &stream{
+        id:         id,
+        sess:       sess,
+        sendWindow: initialStreamWindow,
+        recvNotify: make(chan struct{}, 1),
+        sendNotify: make(chan struct{}, 1),
+    }
+}
+
+// ID returns the stream identifier
+func (st *stream) ID() uint32 {
+    return st.id
+}
+
+// Read reads stream data, blocking until data arrives or the remote closes
+func (st *stream) Read(b []byte) (int, error) {
+    for {
+        st.lock.Lock()
+        if st.recvBuf.Len() > 0 {
+            n, _ := st.recvBuf.Read(b)
+            st.unacked += uint32(n)
+
+            // Grant the window back in batches to avoid an update per read
+            var grant uint32
+            if st.unacked >= initialStreamWindow/2 {
+                grant, st.unacked = st.unacked, 0
+            }
+            st.lock.Unlock()
+
+            if grant > 0 {
+                buf := make([]byte, 4)
+                binary.BigEndian.PutUint32(buf, grant)
+                st.sess.writeFrame(&Frame{Type: StreamWindow, StreamID: st.id, Payload: buf})
+            }
+            return n, nil
+        }
+        if st.remoteFin {
+            st.lock.Unlock()
+            return 0, io.EOF
+        }
+        if st.err != nil {
+            err := st.err
+            st.lock.Unlock()
+            return 0, err
+        }
+        st.lock.Unlock()
+
+        <-st.recvNotify
+    }
+}
+
+// Write sends data on the stream, blocking while the remote's window is full
+func (st *stream) Write(b []byte) (int, error) {
+    total := 0
+    for len(b) > 0 {
+        st.lock.Lock()
+        if st.err != nil {
+            err := st.err
+            st.lock.Unlock()
+            return total, err
+        }
+        if st.localFin {
+            st.lock.Unlock()
+            return total, ErrStreamClosed
+        }
+        if st.sendWindow == 0 {
+            st.lock.Unlock()
+            <-st.sendNotify
+            continue
+        }
+
+        n := len(b)
+        if n > int(st.sendWindow) {
+            n = int(st.sendWindow)
+        }
+        if n > maxDataFrameSize {
+            n = maxDataFrameSize
+        }
+        st.sendWindow -= uint32(n)
+        st.lock.Unlock()
+
+        if err := st.sess.writeFrame(&Frame{Type: StreamData, StreamID: st.id, Payload: b[:n]}); err != nil {
+            return total, err
+        }
+        total += n
+        b = b[n:]
+    }
+
+    return total, nil
+}
+
+// Close half-closes the stream; the remote reads EOF once it drains the data
+func (st *stream) Close() error {
+    st.lock.Lock()
+    if st.localFin || st.err != nil {
+        st.lock.Unlock()
+        return nil
+    }
+    st.localFin = true
+    done := st.remoteFin
+    st.lock.Unlock()
+
+    st.notify()
+    if done {
+        st.sess.removeStream(st.id)
+    }
+
+    return st.sess.writeFrame(&Frame{Type: StreamClose, StreamID: st.id})
+}
+
+// Reset aborts the stream in both directions, it is a no-op once the stream
+// completed so it can be deferred after a clean Close
+func (st *stream) Reset() error {
+    st.lock.Lock()
+    if st.err != nil || (st.localFin && st.remoteFin) {
+        st.lock.Unlock()
+        return nil
+    }
+    st.lock.Unlock()
+
+    st.abort(ErrStreamReset)
+
+    return st.sess.writeFrame(&Frame{Type: StreamReset, StreamID: st.id})
+}
+
+// pushData buffers data received from the remote
+func (st *stream) pushData(b []byte) {
+    st.lock.Lock()
+    if st.err != nil || st.remoteFin {
+        st.lock.Unlock()
+        return
+    }
+    if st.recvBuf.Len()+int(st.unacked)+len(b) > initialStreamWindow {
+        // The remote ignored flow control
+        st.lock.Unlock()
+        st.Reset()
+        return
+    }
+    st.recvBuf.Write(b)
+    st.lock.Unlock()
+
+    st.notify()
+}
+
+// grantWindow adds to the send window after the remote consumed data
+func (st *stream) grantWindow(n uint32) {
+    st.lock.Lock()
+    st.sendWindow += n
+    st.lock.Unlock()
+
+    st.notify()
+}
+
+// remoteClose records that the remote will send no more data
+func (st *stream) remoteClose() {
+    st.lock.Lock()
+    st.remoteFin = true
+    done := st.localFin
+    st.lock.Unlock()
+
+    st.notify()
+    if done {
+        st.sess.removeStream(st.id)
+    }
+}
+
+// abort fails the stream with err and forgets it
+func (st *stream) abort(err error) {
+    st.lock.Lock()
+    if st.err == nil {
+        st.err = err
+    }
+    if err == ErrStreamReset {
+        st.recvBuf.Reset()
+        st.remoteFin = false
+    }
+    st.lock.Unlock()
+
+    st.notify()
+    st.sess.removeStream(st.id)
+}
+
+// notify wakes any blocked reader and writer
+func (st *stream) notify() {
+    select {
+    case st.recvNotify <- struct{}{}:
+    default:
+    }
+    select {
+    case st.sendNotify <- struct{}{}:
+    default:
+    }
+}
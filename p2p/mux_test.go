@@ -0,0 +1,113 @@
+package p2p
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// servePipe runs a session read loop, delivering RPCs to rpcch
+func servePipe(conn net.Conn, sess *session, rpcch chan<- RPC) {
+	defer sess.close()
+	for {
+		f := Frame{}
+		if err := (DefaultDecoder{}).Decode(conn, &f); err != nil {
+			return
+		}
+		rpc, err := sess.handleFrame(&f)
+		if err != nil {
+			return
+		}
+		if rpc != nil {
+			rpcch <- *rpc
+		}
+	}
+}
+
+func TestSessionConcurrentStreams(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	var (
+		local  = newSession(c1, true, DefaultEncoder{})
+		remote = newSession(c2, false, DefaultEncoder{})
+		lrpcch = make(chan RPC, 16)
+		rrpcch = make(chan RPC, 16)
+	)
+	go servePipe(c1, local, lrpcch)
+	go servePipe(c2, remote, rrpcch)
+
+	// Each stream carries more than the initial window so flow control kicks in
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+
+	// Echo every stream back to its opener and answer regular messages
+	go func() {
+		for rpc := range rrpcch {
+			if rpc.Stream == nil {
+				rpc.Payload = append([]byte("pong:"), rpc.Payload...)
+				remote.send(rpc.Payload)
+				continue
+			}
+			go func(st Stream) {
+				io.Copy(st, st)
+				st.Close()
+			}(rpc.Stream)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			st, err := local.openStream([]byte("echo"))
+			assert.Nil(t, err)
+
+			go func() {
+				st.Write(payload)
+				st.Close()
+			}()
+
+			b, err := io.ReadAll(st)
+			assert.Nil(t, err)
+			assert.Equal(t, len(payload), len(b))
+			assert.True(t, bytes.Equal(payload, b))
+		}()
+	}
+
+	// Regular messages are still delivered while streams are busy
+	assert.Nil(t, local.send([]byte("ping")))
+	rpc := <-lrpcch
+	assert.Equal(t, []byte("pong:ping"), rpc.Payload)
+
+	wg.Wait()
+}
+
+func TestSessionStreamReset(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	var (
+		local  = newSession(c1, true, DefaultEncoder{})
+		remote = newSession(c2, false, DefaultEncoder{})
+		rrpcch = make(chan RPC, 1)
+	)
+	go servePipe(c1, local, make(chan RPC, 1))
+	go servePipe(c2, remote, rrpcch)
+
+	st, err := local.openStream(nil)
+	assert.Nil(t, err)
+
+	rpc := <-rrpcch
+	assert.Nil(t, rpc.Stream.Reset())
+
+	_, err = io.ReadAll(st)
+	assert.Equal(t, ErrStreamReset, err)
+}
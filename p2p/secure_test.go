@@ -0,0 +1,78 @@
+package p2p
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newSecureTransport starts an encrypted transport on a loopback port
+func newSecureTransport(t *testing.T, peerch chan<- Peer) (*TCPTransport, *Identity) {
+	id, err := NewIdentity()
+	assert.Nil(t, err)
+
+	tr := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		HandshakeFunc: IdentityHandshakeFunc(id),
+		Identity:      id,
+		Encrypt:       true,
+		OnPeer: func(p Peer) error {
+			peerch <- p
+			return nil
+		},
+	})
+	assert.Nil(t, tr.ListenAndAccept())
+	t.Cleanup(func() { tr.Close() })
+
+	return tr, id
+}
+
+func TestEncryptedTransport(t *testing.T) {
+	var (
+		peersA = make(chan Peer, 1)
+		peersB = make(chan Peer, 1)
+	)
+	a, idA := newSecureTransport(t, peersA)
+	b, idB := newSecureTransport(t, peersB)
+
+	_, err := b.Dial(a.listener.Addr().String())
+	assert.Nil(t, err)
+
+	var pa, pb Peer
+	select {
+	case pa = <-peersA:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for inbound peer")
+	}
+	pb = <-peersB
+
+	// Both sides see the identity bound to the session
+	assert.Equal(t, idB.ID(), pa.ID())
+	assert.Equal(t, idA.ID(), pb.ID())
+
+	conn, ok := pa.(*TCPPeer).conn.(*tls.Conn)
+	assert.True(t, ok)
+	assert.Equal(t, uint16(tls.VersionTLS13), conn.ConnectionState().Version)
+
+	assert.Nil(t, pb.Send([]byte("secret metadata")))
+	rpc := <-a.Consume()
+	assert.Equal(t, idB.ID(), rpc.From)
+	assert.Equal(t, []byte("secret metadata"), rpc.Payload)
+}
+
+func TestEncryptedTransportRejectsPlaintext(t *testing.T) {
+	peers := make(chan Peer, 1)
+	a, _ := newSecureTransport(t, peers)
+
+	plain := NewTCPTransport(TCPTransportOpts{ListenAddr: "127.0.0.1:0"})
+	// The plaintext side has no handshake of its own, only the listener can object
+	plain.Dial(a.listener.Addr().String())
+
+	select {
+	case p := <-peers:
+		t.Fatalf("plaintext peer %s was accepted", p.ID())
+	case <-time.After(500 * time.Millisecond):
+	}
+}
@@ -0,0 +1,224 @@
+package p2p
+
+import (
+    "container/heap"
+    "sync"
+    "time"
+)
+
+// simSettle is how long a running SimClock waits for nothing to be
+// scheduled before it moves on to the next event
+const simSettle = time.Millisecond
+
+// SimClock is a virtual clock for simulations. Its time only moves when it
+// is advanced, running the events scheduled on the way in order of their
+// time, and of scheduling for events at the same time.
+type SimClock struct {
+    advanceLock sync.Mutex // Serialises advancing
+
+    lock   sync.Mutex
+    now    time.Time
+    seq    uint64        // Scheduling order of the last event
+    events simEvents     // Pending events, earliest first
+    wake   chan struct{} // Signalled when an event is scheduled
+}
+
+// simEvent is a function scheduled on a SimClock
+type simEvent struct {
+    at    time.Time
+    seq   uint64
+    fn    func()
+    index int // Position in the heap, -1 once it ran or was removed
+}
+
+// simEvents is a heap of events ordered by time and scheduling
+type simEvents []*simEvent
+
+func (e simEvents) Len() int { return len(e) }
+
+func (e simEvents) Less(i, j int) bool {
+    if !e[i].at.Equal(e[j].at) {
+        return e[i].at.Before(e[j].at)
+    }
+    return e[i].seq < e[j].seq
+}
+
+func (e simEvents) Swap(i, j int) {
+    e[i], e[j] = e[j], e[i]
+    e[i].index, e[j].index = i, j
+}
+
+func (e *simEvents) Push(x any) {
+    ev := x.(*simEvent)
+    ev.index = len(*e)
+    *e = append(*e, ev)
+}
+
+func (e *simEvents) Pop() any {
+    old := *e
+    ev := old[len(old)-1]
+    ev.index = -1
+    *e = old[:len(old)-1]
+    return ev
+}
+
+// NewSimClock creates a clock showing start
+func NewSimClock(start time.Time) *SimClock {
+    return &SimClock{now: start, wake: make(chan struct{}, 1)}
+}
+
+// Now returns the virtual time
+func (c *SimClock) Now() time.Time {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.now
+}
+
+// At schedules fn to run once the clock reaches t, right at the next advance
+// when t already passed. fn runs on the goroutine advancing the clock and
+// must not block.
+func (c *SimClock) At(t time.Time, fn func()) {
+    c.schedule(t, fn)
+}
+
+// AfterFunc schedules fn to run once d passed on the clock
+func (c *SimClock) AfterFunc(d time.Duration, fn func()) {
+    c.At(c.Now().Add(d), fn)
+}
+
+// NewTimer returns a timer firing once d passed on the clock
+func (c *SimClock) NewTimer(d time.Duration) Timer {
+    t := &simTimer{clock: c, ch: make(chan time.Time, 1)}
+    t.ev = c.schedule(c.Now().Add(d), func() {
+        t.ch <- c.Now()
+    })
+    return t
+}
+
+// schedule adds an event and wakes a running clock
+func (c *SimClock) schedule(t time.Time, fn func()) *simEvent {
+    c.lock.Lock()
+    if t.Before(c.now) {
+        t = c.now
+    }
+    c.seq++
+    ev := &simEvent{at: t, seq: c.seq, fn: fn}
+    heap.Push(&c.events, ev)
+    c.lock.Unlock()
+
+    select {
+    case c.wake <- struct{}{}:
+    default:
+    }
+    return ev
+}
+
+// cancel removes an event that hasn't run yet, reporting whether it was
+// still pending
+func (c *SimClock) cancel(ev *simEvent) bool {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    if ev.index < 0 {
+        return false
+    }
+    heap.Remove(&c.events, ev.index)
+    return true
+}
+
+// simTimer is a Timer on a SimClock
+type simTimer struct {
+    clock *SimClock
+    ev    *simEvent
+    ch    chan time.Time
+}
+
+func (t *simTimer) C() <-chan time.Time {
+    return t.ch
+}
+
+func (t *simTimer) Stop() bool {
+    return t.clock.cancel(t.ev)
+}
+
+// Next returns the time of the earliest pending event
+func (c *SimClock) Next() (time.Time, bool) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    if len(c.events) == 0 {
+        return time.Time{}, false
+    }
+    return c.events[0].at, true
+}
+
+// Advance moves the clock forward by d
+func (c *SimClock) Advance(d time.Duration) {
+    c.AdvanceTo(c.Now().Add(d))
+}
+
+// AdvanceTo moves the clock forward to t, running every event due by then.
+// Events scheduled while advancing run too when they fall before t.
+func (c *SimClock) AdvanceTo(t time.Time) {
+    c.advanceLock.Lock()
+    defer c.advanceLock.Unlock()
+
+    for {
+        c.lock.Lock()
+        if len(c.events) == 0 || c.events[0].at.After(t) {
+            if t.After(c.now) {
+                c.now = t
+            }
+            c.lock.Unlock()
+            return
+        }
+        ev := heap.Pop(&c.events).(*simEvent)
+        c.now = ev.at
+        c.lock.Unlock()
+
+        ev.fn()
+    }
+}
+
+// Run advances the clock from one event to the next until quit is closed.
+// Time only moves on once nothing was scheduled for a moment of real time,
+// so goroutines woken by an event react to it first, as if they took no
+// time, and virtual timeouts don't overtake real work.
+func (c *SimClock) Run(quit <-chan struct{}) {
+    settle := time.NewTimer(simSettle)
+    defer settle.Stop()
+
+    for {
+        select {
+        case <-quit:
+            return
+        case <-c.wake:
+            // Still busy, wait for another quiet moment
+            resetTimer(settle, simSettle)
+            continue
+        case <-settle.C:
+        }
+
+        if t, ok := c.Next(); ok {
+            c.AdvanceTo(t)
+        } else {
+            select {
+            case <-c.wake:
+            case <-quit:
+                return
+            }
+        }
+        resetTimer(settle, simSettle)
+    }
+}
+
+// resetTimer restarts a timer whose channel may hold an unread fire
+func resetTimer(t *time.Timer, d time.Duration) {
+    if !t.Stop() {
+        select {
+        case <-t.C:
+        default:
+        }
+    }
+    t.Reset(d)
+}
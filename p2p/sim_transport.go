@@ -0,0 +1,414 @@
+package p2p
+
+import (
+    "bytes"
+    "fmt"
+    "hash/fnv"
+    "io"
+    "math/rand"
+    "net"
+    "os"
+    "sync"
+    "time"
+)
+
+const (
+    defaultRetransmitTimeout = 200 * time.Millisecond // Delay a lost write costs when the link sets none
+    maxRetransmits           = 16                     // Losses of a single write before it gets through regardless
+)
+
+// LinkRule describes the faults on the link from one address to another.
+// Connections stay reliable and ordered like TCP: a lost write is sent
+// again and holds up the writes behind it, and writes only overtake those
+// of other connections.
+type LinkRule struct {
+    Latency           time.Duration // One way delay of every write
+    Jitter            time.Duration // Random extra delay up to it per write
+    Loss              float64       // Chance that sending a write fails
+    RetransmitTimeout time.Duration // Delay each failed send of a write costs
+    Bandwidth         int64         // Bytes per second of each connection, unlimited when zero
+}
+
+// SimNetwork connects SimTransports through links with fault rules, timed
+// on a virtual clock. Faults are drawn from a generator per connection,
+// seeded from the network's seed, the link and how many connections were
+// dialed on it before. A connection sees the same faults for the same
+// writes however the writes of other connections interleave with its own.
+type SimNetwork struct {
+    Clock *SimClock // Delivers the writes in transit
+
+    lock        sync.Mutex
+    seed        int64
+    defaultRule LinkRule
+    rules       map[simLinkID]LinkRule
+    links       map[simLinkID]*simLink
+    dials       map[simLinkID]int // Connections dialed by link
+    groups      map[string]int // Partition group by address
+    listeners   map[string]*memoryListener
+}
+
+// simLinkID is the direction between two addresses
+type simLinkID struct {
+    from string
+    to   string
+}
+
+// simLink is the state of a direction between two addresses
+type simLink struct {
+    held []simWrite // Writes waiting for a partition to heal
+}
+
+// simWrite is data on its way from one end of a connection to the other
+type simWrite struct {
+    from *simConn
+    data []byte // Nil for the end of the stream
+}
+
+// NewSimNetwork creates a network without faults. Its clock starts at the
+// current time and has to be advanced, or Run, for anything to arrive.
+func NewSimNetwork(seed int64) *SimNetwork {
+    return &SimNetwork{
+        Clock:     NewSimClock(time.Now()),
+        seed:      seed,
+        rules:     make(map[simLinkID]LinkRule),
+        links:     make(map[simLinkID]*simLink),
+        dials:     make(map[simLinkID]int),
+        groups:    make(map[string]int),
+        listeners: make(map[string]*memoryListener),
+    }
+}
+
+// SetDefaultLink sets the rule of every link without one of its own
+func (n *SimNetwork) SetDefaultLink(rule LinkRule) {
+    n.lock.Lock()
+    defer n.lock.Unlock()
+    n.defaultRule = rule
+}
+
+// SetLink sets the rule for writes from one address to another
+func (n *SimNetwork) SetLink(from string, to string, rule LinkRule) {
+    n.lock.Lock()
+    defer n.lock.Unlock()
+    n.rules[simLinkID{from, to}] = rule
+}
+
+// Partition splits the given addresses into groups that can't reach each
+// other, addresses left out still reach everyone. Open connections across
+// groups stall rather than close, like a cable pulled out, until Heal.
+func (n *SimNetwork) Partition(groups ...[]string) {
+    n.lock.Lock()
+    defer n.lock.Unlock()
+
+    n.groups = make(map[string]int)
+    for i, group := range groups {
+        for _, addr := range group {
+            n.groups[addr] = i
+        }
+    }
+}
+
+// Heal removes the partition, the writes held up by it are sent
+func (n *SimNetwork) Heal() {
+    n.lock.Lock()
+    defer n.lock.Unlock()
+
+    n.groups = make(map[string]int)
+    for id, l := range n.links {
+        held := l.held
+        l.held = nil
+        for _, w := range held {
+            n.send(id, l, w)
+        }
+    }
+}
+
+// partitioned reports whether two addresses are in different groups, must
+// be called with the lock held
+func (n *SimNetwork) partitioned(a string, b string) bool {
+    ga, oka := n.groups[a]
+    gb, okb := n.groups[b]
+    return oka && okb && ga != gb
+}
+
+// link returns the state of a direction, must be called with the lock held
+func (n *SimNetwork) link(id simLinkID) *simLink {
+    l, ok := n.links[id]
+    if !ok {
+        l = &simLink{}
+        n.links[id] = l
+    }
+    return l
+}
+
+// faults returns the generator of fault decisions for the nth connection
+// dialed from one address to another, one direction of it
+func (n *SimNetwork) faults(id simLinkID, dial int, dir string) *rand.Rand {
+    h := fnv.New64a()
+    fmt.Fprintf(h, "%s\x00%s\x00%d\x00%s", id.from, id.to, dial, dir)
+    return rand.New(rand.NewSource(n.seed ^ int64(h.Sum64())))
+}
+
+// rule returns the rule of a direction, must be called with the lock held
+func (n *SimNetwork) rule(id simLinkID) LinkRule {
+    if rule, ok := n.rules[id]; ok {
+        return rule
+    }
+    return n.defaultRule
+}
+
+// transmit puts a write on its way to the other end of c
+func (n *SimNetwork) transmit(c *simConn, data []byte) {
+    n.lock.Lock()
+    defer n.lock.Unlock()
+
+    id := simLinkID{c.local.String(), c.remote.String()}
+    n.send(id, n.link(id), simWrite{from: c, data: data})
+}
+
+// send schedules the delivery of a write according to the link's rule, or
+// holds it while a partition separates the link, must be called with the
+// lock held
+func (n *SimNetwork) send(id simLinkID, l *simLink, w simWrite) {
+    if n.partitioned(id.from, id.to) {
+        l.held = append(l.held, w)
+        return
+    }
+
+    rule, from := n.rule(id), w.from
+    at := n.Clock.Now()
+    if rule.Bandwidth > 0 {
+        if from.busyUntil.After(at) {
+            at = from.busyUntil
+        }
+        at = at.Add(time.Duration(int64(len(w.data)) * int64(time.Second) / rule.Bandwidth))
+        from.busyUntil = at
+    }
+    at = at.Add(rule.Latency)
+    if rule.Jitter > 0 {
+        at = at.Add(time.Duration(from.faults.Int63n(int64(rule.Jitter) + 1)))
+    }
+    rto := rule.RetransmitTimeout
+    if rto <= 0 {
+        rto = defaultRetransmitTimeout
+    }
+    for i := 0; i < maxRetransmits && rule.Loss > 0 && from.faults.Float64() < rule.Loss; i++ {
+        at = at.Add(rto)
+    }
+
+    // Nothing overtakes earlier writes of the same connection
+    to := from.peer
+    if at.Before(to.arrival) {
+        at = to.arrival
+    }
+    to.arrival = at
+
+    n.Clock.At(at, func() { to.receive(w.data) })
+}
+
+// listen registers a listener at addr
+func (n *SimNetwork) listen(addr string) (net.Listener, error) {
+    n.lock.Lock()
+    defer n.lock.Unlock()
+
+    if _, ok := n.listeners[addr]; ok {
+        return nil, fmt.Errorf("p2p: sim address %s already in use", addr)
+    }
+    l := newMemoryListener(addr, func() {
+        n.lock.Lock()
+        delete(n.listeners, addr)
+        n.lock.Unlock()
+    })
+    n.listeners[addr] = l
+    return l, nil
+}
+
+// dial connects from to the listener at addr, which fails across a
+// partition
+func (n *SimNetwork) dial(from string, addr string) (net.Conn, error) {
+    n.lock.Lock()
+    l, ok := n.listeners[addr]
+    cut := n.partitioned(from, addr)
+    if !ok || cut {
+        n.lock.Unlock()
+        return nil, fmt.Errorf("p2p: dial sim %s: connection refused", addr)
+    }
+    id := simLinkID{from, addr}
+    dial := n.dials[id]
+    n.dials[id]++
+    local := newSimConn(n, from, addr, n.faults(id, dial, "out"))
+    remote := newSimConn(n, addr, from, n.faults(id, dial, "in"))
+    n.lock.Unlock()
+
+    local.peer, remote.peer = remote, local
+    if err := l.deliver(remote); err != nil {
+        return nil, err
+    }
+    return local, nil
+}
+
+// SimTransport is a Transport on a SimNetwork. Only making connections
+// differs from TCPTransport, the handshake, encryption, streams and
+// heartbeats are the same. Heartbeats and the deadlines of connections
+// follow the network's clock.
+type SimTransport struct {
+    *TCPTransport
+}
+
+// NewSimTransport creates a transport on network. Its ListenAddr only needs
+// to be unique within the network, and should look like host:port since
+// nodes exchange it as their dialable address.
+func NewSimTransport(network *SimNetwork, opts TCPTransportOpts) *SimTransport {
+    opts.Clock = network.Clock
+    t := NewTCPTransport(opts)
+    t.listen = network.listen
+    t.dial = func(addr string) (net.Conn, error) {
+        return network.dial(t.ListenAddr, addr)
+    }
+    return &SimTransport{TCPTransport: t}
+}
+
+// simConn is one end of a simulated connection. Writes never block, they
+// are handed to the network and arrive at the other end in time. Deadlines
+// are given in real time like those of any net.Conn, and expire once the
+// same time passed on the network's clock.
+type simConn struct {
+    network *SimNetwork
+    local   memoryAddr
+    remote  memoryAddr
+    peer    *simConn // Other end
+
+    // Guarded by the network lock
+    faults    *rand.Rand // Fault decisions for writes from this end
+    busyUntil time.Time  // When the writes from this end queued for the bandwidth are sent
+    arrival   time.Time  // Latest arrival of a write in transit to this end
+
+    lock     sync.Mutex
+    buf      bytes.Buffer  // Arrived but not read yet
+    eof      bool          // The other end closed and everything it wrote arrived
+    closed   bool          // This end was closed
+    deadline time.Time     // Read deadline on the network's clock
+    expiry   *simEvent     // Wakes a blocked reader at the deadline
+    notify   chan struct{} // Signalled on arrivals and state changes
+}
+
+// newSimConn creates one end of a connection from local to remote
+func newSimConn(n *SimNetwork, local string, remote string, faults *rand.Rand) *simConn {
+    return &simConn{
+        network: n,
+        local:   memoryAddr(local),
+        remote:  memoryAddr(remote),
+        faults:  faults,
+        notify:  make(chan struct{}, 1),
+    }
+}
+
+// wake signals a blocked reader
+func (c *simConn) wake() {
+    select {
+    case c.notify <- struct{}{}:
+    default:
+    }
+}
+
+// receive takes a write arriving from the other end, nil data ends the
+// stream
+func (c *simConn) receive(data []byte) {
+    c.lock.Lock()
+    if !c.closed {
+        if data == nil {
+            c.eof = true
+        } else {
+            c.buf.Write(data)
+        }
+    }
+    c.lock.Unlock()
+
+    c.wake()
+}
+
+// Read reads what arrived, blocking until something does
+func (c *simConn) Read(b []byte) (int, error) {
+    for {
+        c.lock.Lock()
+        switch {
+        case c.closed:
+            c.lock.Unlock()
+            return 0, net.ErrClosed
+        case c.buf.Len() > 0:
+            n, _ := c.buf.Read(b)
+            c.lock.Unlock()
+            return n, nil
+        case c.eof:
+            c.lock.Unlock()
+            return 0, io.EOF
+        case !c.deadline.IsZero() && !c.network.Clock.Now().Before(c.deadline):
+            c.lock.Unlock()
+            return 0, os.ErrDeadlineExceeded
+        }
+        c.lock.Unlock()
+
+        <-c.notify
+    }
+}
+
+// Write sends b to the other end
+func (c *simConn) Write(b []byte) (int, error) {
+    c.lock.Lock()
+    closed := c.closed
+    c.lock.Unlock()
+    if closed {
+        return 0, net.ErrClosed
+    }
+
+    c.network.transmit(c, append([]byte{}, b...))
+    return len(b), nil
+}
+
+// Close closes this end, the other end reads EOF after what is in transit
+func (c *simConn) Close() error {
+    c.lock.Lock()
+    if c.closed {
+        c.lock.Unlock()
+        return nil
+    }
+    c.closed = true
+    c.buf.Reset()
+    c.lock.Unlock()
+
+    c.wake()
+    c.network.transmit(c, nil)
+    return nil
+}
+
+func (c *simConn) LocalAddr() net.Addr  { return c.local }
+func (c *simConn) RemoteAddr() net.Addr { return c.remote }
+
+// SetDeadline sets the read deadline, writes never block
+func (c *simConn) SetDeadline(t time.Time) error {
+    return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets when blocked reads give up
+func (c *simConn) SetReadDeadline(t time.Time) error {
+    clock := c.network.Clock
+
+    c.lock.Lock()
+    if c.expiry != nil {
+        clock.cancel(c.expiry)
+        c.expiry = nil
+    }
+    c.deadline = time.Time{}
+    if !t.IsZero() {
+        c.deadline = clock.Now().Add(time.Until(t))
+        c.expiry = clock.schedule(c.deadline, c.wake)
+    }
+    c.lock.Unlock()
+
+    c.wake()
+    return nil
+}
+
+// SetWriteDeadline is a no-op, writes never block
+func (c *simConn) SetWriteDeadline(time.Time) error {
+    return nil
+}
@@ -0,0 +1,238 @@
+package p2p
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimClock(t *testing.T) {
+	start := time.Unix(0, 0)
+	clock := NewSimClock(start)
+
+	order := []string{}
+	clock.AfterFunc(2*time.Second, func() { order = append(order, "b") })
+	clock.AfterFunc(time.Second, func() {
+		order = append(order, "a")
+		// Scheduled while advancing, still due before the target
+		clock.AfterFunc(500*time.Millisecond, func() { order = append(order, "a2") })
+	})
+	clock.AfterFunc(2*time.Second, func() { order = append(order, "c") })
+	clock.AfterFunc(time.Minute, func() { order = append(order, "late") })
+
+	clock.Advance(2 * time.Second)
+	assert.Equal(t, []string{"a", "a2", "b", "c"}, order)
+	assert.Equal(t, start.Add(2*time.Second), clock.Now())
+
+	next, ok := clock.Next()
+	assert.True(t, ok)
+	assert.Equal(t, start.Add(time.Minute), next)
+}
+
+// simPair connects two raw ends over network
+func simPair(t *testing.T, network *SimNetwork, from string, to string) (net.Conn, net.Conn) {
+	l, err := network.listen(to)
+	assert.Nil(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		assert.Nil(t, err)
+		accepted <- conn
+	}()
+
+	local, err := network.dial(from, to)
+	assert.Nil(t, err)
+	return local, <-accepted
+}
+
+// readWithin reads n bytes from conn, advancing the clock by step until
+// they arrived, and returns the virtual time that took
+func readWithin(t *testing.T, clock *SimClock, conn net.Conn, n int, step time.Duration) time.Duration {
+	start := clock.Now()
+	done := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(conn, buf)
+		assert.Nil(t, err)
+		done <- buf
+	}()
+
+	for i := 0; i < 1000; i++ {
+		select {
+		case <-done:
+			return clock.Now().Sub(start)
+		case <-time.After(time.Millisecond):
+			clock.Advance(step)
+		}
+	}
+	t.Fatal("data never arrived")
+	return 0
+}
+
+func TestSimNetworkLinkRules(t *testing.T) {
+	network := NewSimNetwork(1)
+	network.SetLink("a:1", "b:1", LinkRule{Latency: 100 * time.Millisecond, Bandwidth: 1000})
+	a, b := simPair(t, network, "a:1", "b:1")
+
+	// 500 bytes at 1000 bytes per second plus the latency
+	_, err := a.Write(make([]byte, 500))
+	assert.Nil(t, err)
+	took := readWithin(t, network.Clock, b, 500, 10*time.Millisecond)
+	assert.True(t, took >= 600*time.Millisecond, took)
+	assert.True(t, took < 700*time.Millisecond, took)
+
+	// The way back has no rule
+	_, err = b.Write([]byte("ack"))
+	assert.Nil(t, err)
+	assert.True(t, readWithin(t, network.Clock, a, 3, 10*time.Millisecond) <= 10*time.Millisecond)
+}
+
+func TestSimNetworkLossKeepsOrder(t *testing.T) {
+	network := NewSimNetwork(7)
+	network.SetDefaultLink(LinkRule{Latency: time.Millisecond, Jitter: 20 * time.Millisecond, Loss: 0.3})
+	a, b := simPair(t, network, "a:1", "b:1")
+
+	sent := []byte{}
+	for i := 0; i < 100; i++ {
+		_, err := a.Write([]byte{byte(i)})
+		assert.Nil(t, err)
+		sent = append(sent, byte(i))
+	}
+	network.Clock.Advance(time.Hour)
+
+	got := make([]byte, len(sent))
+	_, err := io.ReadFull(b, got)
+	assert.Nil(t, err)
+	assert.Equal(t, sent, got)
+}
+
+// simTimeline writes on two connections of the same link concurrently and
+// returns when each write arrived, in virtual time from the start
+func simTimeline(t *testing.T, seed int64) []string {
+	network := NewSimNetwork(seed)
+	network.SetDefaultLink(LinkRule{Latency: 5 * time.Millisecond, Jitter: 20 * time.Millisecond, Loss: 0.2, Bandwidth: 64 << 10})
+	start := network.Clock.Now()
+
+	ends := map[string]*simConn{}
+	done := make(chan struct{})
+	for _, name := range []string{"first", "second"} {
+		local, remote := simPair(t, network, "a:1", "b:"+name)
+		ends[name] = remote.(*simConn)
+
+		// Writers race each other, which must not change the faults
+		go func(name string, conn net.Conn) {
+			defer func() { done <- struct{}{} }()
+			for i := 0; i < 50; i++ {
+				_, err := conn.Write([]byte(fmt.Sprintf("%s/%d ", name, i)))
+				assert.Nil(t, err)
+			}
+		}(name, local)
+	}
+	<-done
+	<-done
+
+	timeline := []string{}
+	for {
+		next, ok := network.Clock.Next()
+		if !ok {
+			return timeline
+		}
+		network.Clock.AdvanceTo(next)
+
+		for _, name := range []string{"first", "second"} {
+			c := ends[name]
+			c.lock.Lock()
+			if c.buf.Len() > 0 {
+				timeline = append(timeline, fmt.Sprintf("%s %s", next.Sub(start), c.buf.String()))
+				c.buf.Reset()
+			}
+			c.lock.Unlock()
+		}
+	}
+}
+
+func TestSimNetworkReplaysSeed(t *testing.T) {
+	first := simTimeline(t, 3)
+	assert.Equal(t, first, simTimeline(t, 3))
+	assert.NotEqual(t, first, simTimeline(t, 4))
+}
+
+func TestSimNetworkPartition(t *testing.T) {
+	network := NewSimNetwork(1)
+	a, b := simPair(t, network, "a:1", "b:1")
+
+	network.Partition([]string{"a:1"}, []string{"b:1"})
+	_, err := network.dial("a:1", "b:1")
+	assert.NotNil(t, err)
+
+	// Writes across the partition are held until it heals
+	_, err = a.Write([]byte("held"))
+	assert.Nil(t, err)
+	network.Clock.Advance(time.Hour)
+
+	// Deadlines expire on the network's clock
+	assert.Nil(t, b.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	go network.Clock.Advance(10 * time.Millisecond)
+	_, err = b.Read(make([]byte, 4))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Nil(t, b.SetReadDeadline(time.Time{}))
+
+	network.Heal()
+	assert.True(t, readWithin(t, network.Clock, b, 4, time.Millisecond) <= time.Millisecond)
+
+	// Closing reaches the other end as EOF
+	assert.Nil(t, a.Close())
+	network.Clock.Advance(time.Millisecond)
+	_, err = b.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestSimTransport(t *testing.T) {
+	network := NewSimNetwork(1)
+	network.SetDefaultLink(LinkRule{Latency: 5 * time.Millisecond, Jitter: 5 * time.Millisecond})
+	quit := make(chan struct{})
+	defer close(quit)
+	go network.Clock.Run(quit)
+
+	idA, err := NewIdentity()
+	assert.Nil(t, err)
+	idB, err := NewIdentity()
+	assert.Nil(t, err)
+
+	a := NewSimTransport(network, TCPTransportOpts{
+		ListenAddr:    "alice:1",
+		HandshakeFunc: IdentityHandshakeFunc(idA),
+		Identity:      idA,
+		Encrypt:       true,
+	})
+	assert.Nil(t, a.ListenAndAccept())
+	defer a.Close()
+	b := NewSimTransport(network, TCPTransportOpts{
+		ListenAddr:    "bob:1",
+		HandshakeFunc: IdentityHandshakeFunc(idB),
+		Identity:      idB,
+		Encrypt:       true,
+	})
+	assert.Nil(t, b.ListenAndAccept())
+	defer b.Close()
+
+	p, err := b.Dial("alice:1")
+	assert.Nil(t, err)
+	assert.Equal(t, idA.ID(), p.ID())
+
+	assert.Nil(t, p.Send([]byte("through the simulator")))
+	select {
+	case rpc := <-a.Consume():
+		assert.Equal(t, idB.ID(), rpc.From)
+		assert.Equal(t, []byte("through the simulator"), rpc.Payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message never arrived")
+	}
+}
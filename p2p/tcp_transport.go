@@ -1,38 +1,68 @@
 package p2p
 
 import (
+    "crypto/tls"
     "errors"
     "fmt"
     "log"
     "net"
     "sync"
+    "time"
 )
 
 // TCPPeer represents a remote node over a TCP connection
 type TCPPeer struct {
-    net.Conn       // Embedded net.Conn interface
-    outbound bool  // True if we dialed the connection, false if we accepted it
-    wg       *sync.WaitGroup // WaitGroup for stream synchronization
+    id       string   // Verified node ID, set by the handshake
+    conn     net.Conn // Underlying TCP connection
+    outbound bool     // True if we dialed the connection, false if we accepted it
+    session  *session // Multiplexes messages and streams over conn
 }
 
 // NewTCPPeer creates a new TCPPeer instance
-func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
+func NewTCPPeer(conn net.Conn, outbound bool, encoder Encoder) *TCPPeer {
+    if encoder == nil {
+        encoder = DefaultEncoder{}
+    }
     return &TCPPeer{
-        Conn:     conn,
+        conn:     conn,
         outbound: outbound,
-        wg:       &sync.WaitGroup{},
+        session:  newSession(conn, outbound, encoder),
     }
 }
 
-// CloseStream signals the end of a stream
-func (p *TCPPeer) CloseStream() {
-    p.wg.Done()
+// ID returns the verified node ID, or the remote address when the handshake
+// does not authenticate peers
+func (p *TCPPeer) ID() string {
+    if len(p.id) == 0 {
+        return p.conn.RemoteAddr().String()
+    }
+    return p.id
 }
 
-// Send writes data to the peer connection
+// RemoteAddr returns the remote network address
+func (p *TCPPeer) RemoteAddr() net.Addr {
+    return p.conn.RemoteAddr()
+}
+
+// Close closes the connection and every stream on it
+func (p *TCPPeer) Close() error {
+    p.session.close()
+    return p.conn.Close()
+}
+
+// Send writes a framed message to the peer connection
 func (p *TCPPeer) Send(b []byte) error {
-    _, err := p.Conn.Write(b)
-    return err
+    return p.session.send(b)
+}
+
+// OpenStream opens a new logical stream, delivering header to the remote with it
+func (p *TCPPeer) OpenStream(header []byte) (Stream, error) {
+    return p.session.openStream(header)
+}
+
+// Stats returns the connection health measured by heartbeats
+func (p *TCPPeer) Stats() PeerStats {
+    return p.session.stats()
 }
 
 // TCPTransportOpts contains configuration options for TCPTransport
@@ -40,7 +70,14 @@ type TCPTransportOpts struct {
     ListenAddr    string        // Address to listen on
     HandshakeFunc HandshakeFunc // Function to perform handshake
     Decoder       Decoder       // Message decoder
+    Encoder       Encoder       // Message encoder
     OnPeer        func(Peer) error // Callback when new peer connects
+    OnPeerDisconnect func(Peer)    // Callback once a connected peer is gone
+    Identity      *Identity        // Node key pair, required when Encrypt is set
+    Encrypt       bool             // Wrap connections in mutually authenticated TLS 1.3
+    HeartbeatInterval time.Duration // Time between heartbeats, the default when zero, none when negative
+    HeartbeatMisses   int           // Heartbeats left unanswered in a row before dropping a peer
+    Clock             Clock         // Times heartbeats, real time when nil
 }
 
 // TCPTransport implements the Transport interface using TCP
@@ -48,16 +85,47 @@ type TCPTransport struct {
     TCPTransportOpts            // Embedded options
     listener      net.Listener  // TCP listener
     rpcch         chan RPC     // Channel for incoming RPC messages
+
+    listen func(addr string) (net.Listener, error) // Opens the listener
+    dial   func(addr string) (net.Conn, error)     // Connects to a remote
+
+    tlsOnce   sync.Once   // Guards lazy TLS setup
+    tlsConfig *tls.Config // Session encryption config derived from Identity
+    tlsErr    error       // Error building tlsConfig
 }
 
 // NewTCPTransport creates a new TCPTransport instance
 func NewTCPTransport(opts TCPTransportOpts) *TCPTransport {
+    if opts.HandshakeFunc == nil {
+        opts.HandshakeFunc = NOPHandshakeFunc
+    }
+    if opts.Decoder == nil {
+        opts.Decoder = DefaultDecoder{}
+    }
+    if opts.Encoder == nil {
+        opts.Encoder = DefaultEncoder{}
+    }
+    if opts.Clock == nil {
+        opts.Clock = systemClock{}
+    }
     return &TCPTransport{
         TCPTransportOpts: opts,
         rpcch:            make(chan RPC, 1024), // Buffered channel for RPCs
+        listen:           listenTCP,
+        dial:             dialTCP,
     }
 }
 
+// listenTCP listens for TCP connections on addr
+func listenTCP(addr string) (net.Listener, error) {
+    return net.Listen("tcp", addr)
+}
+
+// dialTCP opens a TCP connection to addr
+func dialTCP(addr string) (net.Conn, error) {
+    return net.Dial("tcp", addr)
+}
+
 // Addr returns the listen address
 func (t *TCPTransport) Addr() string {
     return t.ListenAddr
@@ -73,23 +141,49 @@ func (t *TCPTransport) Close() error {
     return t.listener.Close()
 }
 
-// Dial connects to a remote peer
-func (t *TCPTransport) Dial(addr string) error {
-    conn, err := net.Dial("tcp", addr)
+// secureConfig returns the TLS configuration, building it on first use
+func (t *TCPTransport) secureConfig() (*tls.Config, error) {
+    t.tlsOnce.Do(func() {
+        t.tlsConfig, t.tlsErr = newTLSConfig(t.Identity)
+    })
+    return t.tlsConfig, t.tlsErr
+}
+
+// Dial connects to a remote peer and returns it once the handshake completed
+func (t *TCPTransport) Dial(addr string) (Peer, error) {
+    if t.Encrypt {
+        if _, err := t.secureConfig(); err != nil {
+            return nil, err
+        }
+    }
+
+    conn, err := t.dial(addr)
     if err != nil {
-        return err
+        return nil, err
     }
 
-    go t.handleConn(conn, true) // Handle outbound connection
+    peer, err := t.setupConn(conn, true)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
 
-    return nil
+    go t.readLoop(peer) // Handle outbound connection
+
+    return peer, nil
 }
 
 // ListenAndAccept starts listening for incoming connections
 func (t *TCPTransport) ListenAndAccept() error {
     var err error
 
-    t.listener, err = net.Listen("tcp", t.ListenAddr)
+    if t.Encrypt {
+        if _, err = t.secureConfig(); err != nil {
+            return err
+        }
+    }
+
+    t.listener, err = t.listen(t.ListenAddr)
     if err != nil {
         return err
     }
@@ -117,48 +211,95 @@ func (t *TCPTransport) startAcceptLoop() {
     }
 }
 
-// handleConn manages an established connection
+// handleConn manages an accepted connection
 func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
-    var err error
-
-    defer func() {
-        fmt.Printf("dropping peer connection: %s", err)
+    peer, err := t.setupConn(conn, outbound)
+    if err != nil {
+        fmt.Printf("dropping peer connection: %s\n", err)
         conn.Close()
-    }()
+        return
+    }
+
+    t.readLoop(peer)
+}
+
+// setupConn secures and authenticates a new connection and announces the peer
+func (t *TCPTransport) setupConn(conn net.Conn, outbound bool) (*TCPPeer, error) {
+    var sessionID string // Node ID bound to the encrypted session
 
-    peer := NewTCPPeer(conn, outbound)
+    // Encrypt the connection before anything else goes over it
+    if t.Encrypt {
+        config, _ := t.secureConfig()
+        secured, id, err := secureConn(conn, outbound, config, t.Identity)
+        if err != nil {
+            return nil, err
+        }
+        conn, sessionID = secured, id
+    }
+
+    peer := NewTCPPeer(conn, outbound, t.Encoder)
+    peer.session.writeTimeout = t.writeTimeout()
+    peer.session.clock = t.Clock
 
     // Perform handshake
-    if err = t.HandshakeFunc(peer); err != nil {
-        return
+    var err error
+    if peer.id, err = t.HandshakeFunc(conn, outbound); err != nil {
+        return nil, err
+    }
+
+    // The handshake must agree with the key that secured the session
+    if len(sessionID) > 0 {
+        if len(peer.id) == 0 {
+            peer.id = sessionID
+        } else if peer.id != sessionID {
+            return nil, ErrIdentityMismatch
+        }
     }
 
     // Notify about new peer
     if t.OnPeer != nil {
-        if err = t.OnPeer(peer); err != nil {
-            return
+        if err := t.OnPeer(peer); err != nil {
+            return nil, err
         }
     }
 
-    // Read loop for incoming messages
+    return peer, nil
+}
+
+// readLoop reads frames from the peer until the connection fails
+func (t *TCPTransport) readLoop(peer *TCPPeer) {
+    var err error
+
+    defer func() {
+        fmt.Printf("dropping peer connection: %s\n", err)
+        peer.Close()
+
+        // Only peers announced through OnPeer get here
+        if t.OnPeerDisconnect != nil {
+            t.OnPeerDisconnect(peer)
+        }
+    }()
+
+    go t.heartbeat(peer) // Notice when the peer stops answering
+
+    // Read loop for incoming frames
     for {
-        rpc := RPC{}
-        err = t.Decoder.Decode(conn, &rpc)
-        if err != nil {
+        frame := Frame{}
+        if err = t.Decoder.Decode(peer.conn, &frame); err != nil {
             return
         }
+        peer.session.seen()
 
-        rpc.From = conn.RemoteAddr().String() // Set message source
-
-        if rpc.Stream {
-            // Handle streaming data
-            peer.wg.Add(1)
-            fmt.Printf("[%s] incoming stream, waiting...\n", conn.RemoteAddr())
-            peer.wg.Wait()
-            fmt.Printf("[%s] stream closed, resuming read loop\n", conn.RemoteAddr())
+        var rpc *RPC
+        rpc, err = peer.session.handleFrame(&frame)
+        if err != nil {
+            return
+        }
+        if rpc == nil {
             continue
         }
 
-        t.rpcch <- rpc // Send RPC to consumer channel
+        rpc.From = peer.ID() // Set message source
+        t.rpcch <- *rpc      // Send RPC to consumer channel
     }
-}
\ No newline at end of file
+}
@@ -2,18 +2,42 @@ package p2p
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestTCPTransport(t *testing.T) {
 	opts := TCPTransportOpts{
-		ListenAddr:    ":3000",
+		ListenAddr:    "127.0.0.1:0",
 		HandshakeFunc: NOPHandshakeFunc,
 		Decoder:       DefaultDecoder{},
 	}
 	tr := NewTCPTransport(opts)
-	assert.Equal(t, tr.ListenAddr, ":3000")
+	assert.Equal(t, tr.ListenAddr, "127.0.0.1:0")
 
 	assert.Nil(t, tr.ListenAndAccept())
+	assert.Nil(t, tr.Close())
+}
+
+func TestTCPTransportOnPeerDisconnect(t *testing.T) {
+	gone := make(chan Peer, 1)
+	a := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:       "127.0.0.1:0",
+		OnPeerDisconnect: func(p Peer) { gone <- p },
+	})
+	assert.Nil(t, a.ListenAndAccept())
+	t.Cleanup(func() { a.Close() })
+
+	b := NewTCPTransport(TCPTransportOpts{ListenAddr: "127.0.0.1:0"})
+	p, err := b.Dial(a.listener.Addr().String())
+	assert.Nil(t, err)
+	assert.Nil(t, p.Close())
+
+	select {
+	case dropped := <-gone:
+		assert.Equal(t, p.(*TCPPeer).conn.LocalAddr().String(), dropped.RemoteAddr().String())
+	case <-time.After(5 * time.Second):
+		t.Fatal("disconnect not reported")
+	}
 }
@@ -4,16 +4,19 @@ import "net"
 
 // Peer represents a remote node in the network
 type Peer interface {
-    net.Conn          // Embedded connection interface
-    Send([]byte) error // Send data to peer
-    CloseStream()     // Close an active stream
+    ID() string                        // Verified node ID of the remote
+    RemoteAddr() net.Addr              // Remote network address
+    Close() error                      // Close the connection
+    Send([]byte) error                 // Send a framed message to peer
+    OpenStream([]byte) (Stream, error) // Open a stream carrying the given header
+    Stats() PeerStats                  // Connection health measured by heartbeats
 }
 
 // Transport handles communication between nodes
 type Transport interface {
-    Addr() string            // Listening address
-    Dial(string) error       // Connect to remote address
-    ListenAndAccept() error  // Start listening
-    Consume() <-chan RPC     // Channel for incoming messages
-    Close() error            // Shutdown transport
+    Addr() string              // Listening address
+    Dial(string) (Peer, error) // Connect to remote address
+    ListenAndAccept() error    // Start listening
+    Consume() <-chan RPC       // Channel for incoming messages
+    Close() error              // Shutdown transport
 }
\ No newline at end of file
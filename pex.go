@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	addressBookFileName = "peers.json"     // File under the storage root keeping known peers
+	defaultTargetPeers  = 8                // Connections a node keeps up when none is configured
+	defaultPEXInterval  = 30 * time.Second // Time between peer exchanges when none is configured
+	pexSampleSize       = 32               // Most peers shared in one exchange, and taken from one
+	maxAddrFailures     = 3                // Failed dials in a row before an address is forgotten
+	maxAddressBookSize  = 1024             // Most peers the address book keeps
+)
+
+// MessagePeerExchange shares known peers with a node, which answers with
+// the peers it knows
+type MessagePeerExchange struct {
+	Peers []Contact // Sample of the sender's known peers
+}
+
+// MessagePeerExchangeResponse answers MessagePeerExchange
+type MessagePeerExchangeResponse struct {
+	Peers []Contact // Sample of the responder's known peers
+}
+
+// addressEntry is a peer address in the address book
+type addressEntry struct {
+	Contact
+	Seen     int64 // Unix nanoseconds of the last connection, zero if only heard of
+	Failures int   // Dials failed in a row
+}
+
+// addressBook remembers the addresses of peers across restarts, so a node
+// can rejoin the network without bootstrap addresses. Addresses heard of
+// from other nodes are only shared on once connecting to them worked, and
+// make way for verified ones when the book is full.
+type addressBook struct {
+	path string // Persisted here, empty to keep it in memory
+	self string // Own node ID, never recorded
+
+	lock    sync.Mutex
+	entries map[string]*addressEntry // By node ID
+	dirty   bool                     // Peers were heard of since the last save
+}
+
+// newAddressBook creates an empty address book persisted at path
+func newAddressBook(path string, self string) *addressBook {
+	return &addressBook{path: path, self: self, entries: make(map[string]*addressEntry)}
+}
+
+// loadAddressBook reads the address book persisted at path
+func loadAddressBook(path string, self string) (*addressBook, error) {
+	b := newAddressBook(path, self)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	list := []addressEntry{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("address book %s: %w", path, err)
+	}
+	for i := range list {
+		if e := list[i]; e.ID != self && len(e.Addr) > 0 {
+			b.entries[e.ID] = &e
+		}
+	}
+	return b, nil
+}
+
+// learn records peers heard of from another node and reports whether any
+// was new. Known addresses are kept, a verified one beats hearsay. Only the
+// first pexSampleSize contacts are looked at, as many as a node shares, and
+// none displaces a verified peer. They are saved with the next flush.
+func (b *addressBook) learn(contacts []Contact) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(contacts) > pexSampleSize {
+		contacts = contacts[:pexSampleSize]
+	}
+
+	learned := false
+	for _, c := range contacts {
+		if c.ID == b.self || len(c.ID) == 0 || len(c.Addr) == 0 {
+			continue
+		}
+		if _, ok := b.entries[c.ID]; ok {
+			continue
+		}
+		if !b.makeRoom(false) {
+			break
+		}
+		b.entries[c.ID] = &addressEntry{Contact: c}
+		learned = true
+	}
+	b.dirty = b.dirty || learned
+	return learned
+}
+
+// connected records a peer reached at its address
+func (b *addressBook) connected(c Contact) error {
+	if c.ID == b.self || len(c.Addr) == 0 {
+		return nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.entries[c.ID]; !ok {
+		b.makeRoom(true)
+	}
+	b.entries[c.ID] = &addressEntry{Contact: c, Seen: time.Now().UnixNano()}
+	return b.save()
+}
+
+// makeRoom evicts a peer when the book is full and reports whether there is
+// room for another. Peers never connected to go first, the one connected to
+// longest ago only when verified is set. It must be called with the lock
+// held.
+func (b *addressBook) makeRoom(verified bool) bool {
+	if len(b.entries) < maxAddressBookSize {
+		return true
+	}
+
+	var oldest *addressEntry
+	for id, e := range b.entries {
+		if e.Seen == 0 {
+			delete(b.entries, id)
+			return true
+		}
+		if oldest == nil || e.Seen < oldest.Seen {
+			oldest = e
+		}
+	}
+	if !verified || oldest == nil {
+		return false
+	}
+	delete(b.entries, oldest.ID)
+	return true
+}
+
+// failed records a failed dial, forgetting the address after too many
+func (b *addressBook) failed(id string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	e, ok := b.entries[id]
+	if !ok {
+		return nil
+	}
+	if e.Failures++; e.Failures >= maxAddrFailures {
+		delete(b.entries, id)
+	}
+	return b.save()
+}
+
+// sample returns up to n random peers this node connected to, leaving out
+// the one it is shared with
+func (b *addressBook) sample(n int, exclude string) []Contact {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	contacts := []Contact{}
+	for _, e := range b.entries {
+		if e.Seen > 0 && e.ID != exclude {
+			contacts = append(contacts, e.Contact)
+		}
+	}
+	rand.Shuffle(len(contacts), func(i, j int) { contacts[i], contacts[j] = contacts[j], contacts[i] })
+	if len(contacts) > n {
+		contacts = contacts[:n]
+	}
+	return contacts
+}
+
+// candidates returns every known peer, those connected to most recently
+// first and those never reached last
+func (b *addressBook) candidates() []Contact {
+	b.lock.Lock()
+	entries := make([]addressEntry, 0, len(b.entries))
+	for _, e := range b.entries {
+		entries = append(entries, *e)
+	}
+	b.lock.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Seen != entries[j].Seen {
+			return entries[i].Seen > entries[j].Seen
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	contacts := make([]Contact, len(entries))
+	for i, e := range entries {
+		contacts[i] = e.Contact
+	}
+	return contacts
+}
+
+// flush persists the peers heard of since the last save
+func (b *addressBook) flush() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !b.dirty {
+		return nil
+	}
+	return b.save()
+}
+
+// save persists the address book, must be called with the lock held
+func (b *addressBook) save() error {
+	b.dirty = false
+	if len(b.path) == 0 {
+		return nil
+	}
+
+	list := make([]addressEntry, 0, len(b.entries))
+	for _, e := range b.entries {
+		list = append(list, *e)
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(b.path, data)
+}
+
+// addressBookPath returns where the address book of a storage root lives
+func addressBookPath(root string) string {
+	return filepath.Join(root, addressBookFileName)
+}
+
+// connectedContacts returns the contacts of the connected peers
+func (s *FileServer) connectedContacts() []Contact {
+	s.peerLock.Lock()
+	ids := make([]string, 0, len(s.peers))
+	for id := range s.peers {
+		ids = append(ids, id)
+	}
+	s.peerLock.Unlock()
+
+	contacts := []Contact{}
+	for _, id := range ids {
+		if c, ok := s.rt.contact(id); ok {
+			contacts = append(contacts, c)
+		}
+	}
+	return contacts
+}
+
+// learnPeers adds peers heard of to the address book, waking the exchange
+// loop when that could bring more connections up
+func (s *FileServer) learnPeers(contacts []Contact) {
+	if !s.book.learn(contacts) {
+		return
+	}
+	select {
+	case s.pexch <- struct{}{}:
+	default:
+	}
+}
+
+// exchangePeers swaps known peers with a node
+func (s *FileServer) exchangePeers(ctx context.Context, c Contact) error {
+	reply, err := s.callContact(ctx, c, MessagePeerExchange{Peers: s.book.sample(pexSampleSize, c.ID)})
+	if err != nil {
+		return err
+	}
+	res, ok := reply.Payload.(MessagePeerExchangeResponse)
+	if !ok {
+		return fmt.Errorf("unexpected reply %T", reply.Payload)
+	}
+	s.learnPeers(res.Peers)
+	return nil
+}
+
+// fillPeers dials known peers until TargetPeers are connected and reports
+// whether it connected any. Right after learning of peers every node that
+// heard of them does this, so only the side with the lower ID dials then
+// and two nodes don't dial each other at once.
+func (s *FileServer) fillPeers(learned bool) bool {
+	dialed := false
+	for _, c := range s.book.candidates() {
+		if len(s.connectedContacts()) >= s.TargetPeers {
+			break
+		}
+		if s.isConnected(c.ID) || (learned && c.ID < s.ID) {
+			continue
+		}
+
+		if _, err := s.dialContact(c); err != nil {
+			log.Printf("[%s] dialing known peer %s failed: %s", s.Transport.Addr(), c.Addr, err)
+			if err := s.book.failed(c.ID); err != nil {
+				log.Printf("[%s] saving address book failed: %s", s.Transport.Addr(), err)
+			}
+			continue
+		}
+		dialed = true
+	}
+	return dialed
+}
+
+// exchangeRound swaps peers with a random connected node and brings
+// connections up to TargetPeers
+func (s *FileServer) exchangeRound(learned bool) {
+	ctx := context.Background()
+
+	if peers := s.connectedContacts(); len(peers) > 0 && !learned {
+		c := peers[rand.Intn(len(peers))]
+		if err := s.exchangePeers(ctx, c); err != nil {
+			log.Printf("[%s] peer exchange with %s failed: %s", s.Transport.Addr(), c.Addr, err)
+		}
+	}
+
+	isolated := len(s.connectedContacts()) == 0
+	if s.fillPeers(learned) && isolated {
+		// Announce ourselves like after dialing a bootstrap node
+		s.lookup(ctx, toNodeID(s.ID), nil)
+	}
+
+	// Peers heard of are saved once a round rather than per exchange
+	if err := s.book.flush(); err != nil {
+		log.Printf("[%s] saving address book failed: %s", s.Transport.Addr(), err)
+	}
+}
+
+// pexLoop exchanges peers every PEXInterval, and right away once
+// new peers were heard of, until the server stops. Its first round rejoins
+// the peers of the address book.
+func (s *FileServer) pexLoop() {
+	ticker := time.NewTicker(s.PEXInterval)
+	defer ticker.Stop()
+
+	s.exchangeRound(false)
+	for {
+		select {
+		case <-ticker.C:
+			s.exchangeRound(false)
+		case <-s.pexch:
+			s.exchangeRound(true)
+		case <-s.quitch:
+			if err := s.book.flush(); err != nil {
+				log.Printf("[%s] saving address book failed: %s", s.Transport.Addr(), err)
+			}
+			return
+		}
+	}
+}
+
+// handleMessagePeerExchange records the peers a node shared and answers
+// with ours
+func (s *FileServer) handleMessagePeerExchange(from string, id uint64, msg MessagePeerExchange) error {
+	s.learnPeers(msg.Peers)
+	return s.respond(from, id, MessagePeerExchangeResponse{Peers: s.book.sample(pexSampleSize, from)})
+}
+
+func init() {
+	gob.Register(MessagePeerExchange{})
+	gob.Register(MessagePeerExchangeResponse{})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/utkarshgupta2804/p2p-filestorage/p2p"
+)
+
+func TestAddressBook(t *testing.T) {
+	path := filepath.Join(t.TempDir(), addressBookFileName)
+	book := newAddressBook(path, "self")
+
+	alice := Contact{ID: "alice", Addr: "127.0.0.1:3000"}
+	if !book.learn([]Contact{alice, {ID: "self", Addr: ":1"}, {ID: "noaddr"}}) {
+		t.Fatal("alice not learned")
+	}
+	if book.learn([]Contact{alice}) {
+		t.Error("known peer learned again")
+	}
+
+	// Hearsay is saved in batches
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("have %v saved right away", err)
+	}
+	if err := book.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("not saved on flush: %s", err)
+	}
+
+	// Hearsay isn't passed on until connecting worked
+	if have := book.sample(pexSampleSize, ""); len(have) != 0 {
+		t.Errorf("have %v shared before connecting", have)
+	}
+	bob := Contact{ID: "bob", Addr: "127.0.0.1:7000"}
+	if err := book.connected(bob); err != nil {
+		t.Fatal(err)
+	}
+	if have := book.sample(pexSampleSize, ""); len(have) != 1 || have[0] != bob {
+		t.Errorf("have %v want bob", have)
+	}
+	if have := book.sample(pexSampleSize, "bob"); len(have) != 0 {
+		t.Errorf("have %v shared bob with bob", have)
+	}
+	if have := book.candidates(); len(have) != 2 || have[0] != bob {
+		t.Errorf("have %v want bob, then alice", have)
+	}
+
+	for i := 0; i < maxAddrFailures; i++ {
+		if err := book.failed("alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reloaded, err := loadAddressBook(path, "self")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := reloaded.candidates(); len(have) != 1 || have[0] != bob {
+		t.Errorf("have %v after reloading want bob only", have)
+	}
+}
+
+func TestAddressBookBounded(t *testing.T) {
+	book := newAddressBook("", "self")
+	contacts := func(prefix string, n int) []Contact {
+		list := make([]Contact, n)
+		for i := range list {
+			list[i] = Contact{ID: fmt.Sprintf("%s%d", prefix, i), Addr: fmt.Sprintf("127.0.0.1:%d", i)}
+		}
+		return list
+	}
+
+	// A node sharing more than it may only gets the first peers in
+	book.learn(contacts("flood", 10*pexSampleSize))
+	if have := len(book.entries); have != pexSampleSize {
+		t.Errorf("have %d peers learned want %d", have, pexSampleSize)
+	}
+
+	// Hearsay fills the book, verified peers then push it out
+	for i := 0; len(book.entries) < maxAddressBookSize; i++ {
+		book.learn(contacts(fmt.Sprintf("heard%d.", i), pexSampleSize))
+	}
+	for _, c := range contacts("verified", maxAddressBookSize) {
+		if err := book.connected(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if have := len(book.sample(2*maxAddressBookSize, "")); have != maxAddressBookSize {
+		t.Errorf("have %d verified peers want %d", have, maxAddressBookSize)
+	}
+
+	// Once full of verified peers hearsay is turned away, a newly verified
+	// peer replaces the one seen longest ago
+	if book.learn(contacts("late", 1)) {
+		t.Error("hearsay displaced a verified peer")
+	}
+	if err := book.connected(Contact{ID: "newest", Addr: "127.0.0.1:1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := book.entries["newest"]; !ok || len(book.entries) != maxAddressBookSize {
+		t.Errorf("have %d peers, newest kept %v", len(book.entries), ok)
+	}
+}
+
+func TestPeerExchange(t *testing.T) {
+	t.Parallel()
+
+	network := p2p.NewMemoryNetwork()
+	hub := newTestServer(t, network, filepath.Join(t.TempDir(), "hub"))
+	a := newTestServer(t, network, filepath.Join(t.TempDir(), "a"), hub.Transport.Addr())
+	b := newTestServer(t, network, filepath.Join(t.TempDir(), "b"), hub.Transport.Addr())
+
+	// Both only know the hub, which tells each about the other
+	waitFor(t, "a and b connected", func() bool { return a.isConnected(b.ID) && b.isConnected(a.ID) })
+
+	// A node started over a's address book rejoins without bootstrap nodes
+	root := filepath.Join(t.TempDir(), "rejoined")
+	book, err := os.ReadFile(addressBookPath(a.store.Root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(addressBookPath(root), book, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rejoined := newTestServer(t, network, root)
+	waitFor(t, "the node rejoined", func() bool {
+		return rejoined.isConnected(hub.ID) && rejoined.isConnected(b.ID)
+	})
+}
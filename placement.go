@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReplicationFactor = 3                      // Peers holding each key
+	virtualNodes             = 64                     // Ring positions per node
+	rebalanceDelay           = 500 * time.Millisecond // Coalesces bursts of membership changes
+)
+
+// ringPoint is a single virtual node on the hash ring
+type ringPoint struct {
+	hash uint64
+	id   string
+}
+
+// hashRing places keys on nodes with consistent hashing, so a membership
+// change only moves the keys next to the affected node's virtual nodes
+type hashRing struct {
+	lock   sync.RWMutex
+	points []ringPoint     // Sorted by hash
+	nodes  map[string]bool // Member node IDs
+}
+
+// newHashRing creates an empty ring
+func newHashRing() *hashRing {
+	return &hashRing{
+		nodes: make(map[string]bool),
+	}
+}
+
+// ringHash maps a string onto the ring
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// add places a node on the ring
+func (r *hashRing) add(id string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.nodes[id] {
+		return
+	}
+	r.nodes[id] = true
+
+	for i := 0; i < virtualNodes; i++ {
+		r.points = append(r.points, ringPoint{
+			hash: ringHash(fmt.Sprintf("%s#%d", id, i)),
+			id:   id,
+		})
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+}
+
+// remove takes a node off the ring
+func (r *hashRing) remove(id string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.nodes[id] {
+		return
+	}
+	delete(r.nodes, id)
+
+	points := r.points[:0]
+	for _, p := range r.points {
+		if p.id != id {
+			points = append(points, p)
+		}
+	}
+	r.points = points
+}
+
+// owners returns the n distinct nodes responsible for key, walking the ring
+// clockwise from the key's position. The exclude node, the file's origin,
+// is skipped since it already holds its own copy.
+func (r *hashRing) owners(key string, n int, exclude string) []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	owners := []string{}
+	if len(r.points) == 0 {
+		return owners
+	}
+
+	h := ringHash(key)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+
+	seen := map[string]bool{exclude: true}
+	for i := 0; i < len(r.points) && len(owners) < n; i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if !seen[p.id] {
+			seen[p.id] = true
+			owners = append(owners, p.id)
+		}
+	}
+
+	return owners
+}
+
+// holding is a file stored on this node that takes part in rebalancing. The
+// origin keeps plaintext under the original key, replicas keep ciphertext
+// under the hashed key.
+type holding struct {
+	ID       string // File owner ID, the node the file originates from
+	Key      string // Hashed file key used on the network
+	LocalKey string // Key the file is stored under locally
+	Origin   bool   // This node stored the file
+}
+
+// track records a local file for rebalancing
+func (s *FileServer) track(h holding) {
+	s.holdLock.Lock()
+	defer s.holdLock.Unlock()
+
+	s.holdings[h.ID+"/"+h.Key] = h
+}
+
+// untrack forgets a local file
+func (s *FileServer) untrack(h holding) {
+	s.holdLock.Lock()
+	defer s.holdLock.Unlock()
+
+	delete(s.holdings, h.ID+"/"+h.Key)
+}
+
+// loadHoldings tracks the files stored before a restart, as listed by the
+// persistent index. Files of other nodes are only replicas when encrypted,
+// plaintext left behind by an earlier identity of this node is skipped.
+func (s *FileServer) loadHoldings() {
+	s.store.Walk(func(info FileInfo) error {
+		if info.ID == s.ID {
+			s.track(holding{ID: s.ID, Key: s.hashKey(info.Key), LocalKey: info.Key, Origin: true})
+			return nil
+		}
+		if m, err := s.store.ReadManifest(info.ID, info.Key); err != nil || len(m.Keys) == 0 {
+			return nil
+		}
+		s.track(holding{ID: info.ID, Key: info.Key, LocalKey: info.Key})
+		return nil
+	})
+}
+
+// scheduleRebalance requests a rebalance after membership changed
+func (s *FileServer) scheduleRebalance() {
+	select {
+	case s.rebalancech <- struct{}{}:
+	default:
+	}
+}
+
+// rebalanceLoop runs rebalances until the server stops
+func (s *FileServer) rebalanceLoop() {
+	for {
+		select {
+		case <-s.rebalancech:
+			// Let the membership settle before moving data around
+			select {
+			case <-time.After(rebalanceDelay):
+			case <-s.quitch:
+				return
+			}
+			s.rebalance()
+
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// rebalance pushes every local file to responsible nodes that lack it, and
+// hands off replicas this node is no longer responsible for
+func (s *FileServer) rebalance() {
+	s.holdLock.Lock()
+	holdings := make([]holding, 0, len(s.holdings))
+	for _, h := range s.holdings {
+		holdings = append(holdings, h)
+	}
+	s.holdLock.Unlock()
+
+	for _, h := range holdings {
+		if !s.store.Has(h.ID, h.LocalKey) {
+			s.untrack(h)
+			continue
+		}
+
+		owners := s.ring.owners(h.Key, s.ReplicationFactor, h.ID)
+		responsible, confirmed := false, 0
+		for _, id := range owners {
+			if id == s.ID {
+				responsible = true
+				confirmed++
+				continue
+			}
+			if err := s.ensureReplica(id, h); err != nil {
+				log.Printf("[%s] rebalance of (%s) to %s failed: %s", s.Transport.Addr(), h.Key, id, err)
+				continue
+			}
+			confirmed++
+		}
+
+		if !h.Origin && !responsible && confirmed == len(owners) && len(owners) > 0 {
+			log.Printf("[%s] handing off (%s), no longer responsible", s.Transport.Addr(), h.Key)
+			if err := s.store.Delete(h.ID, h.LocalKey); err != nil {
+				log.Printf("[%s] handoff delete failed: %s", s.Transport.Addr(), err)
+				continue
+			}
+			s.untrack(h)
+		}
+	}
+}
+
+// ensureReplica makes sure the node with the given ID holds the file
+func (s *FileServer) ensureReplica(id string, h holding) error {
+	c, ok := s.rt.contact(id)
+	if !ok {
+		return fmt.Errorf("no contact for node %s", id)
+	}
+	peer, err := s.dialContact(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+
+	reply, err := s.call(ctx, peer, MessageFindValue{ID: h.ID, Key: h.Key})
+	if err != nil {
+		return err
+	}
+	if nodes, ok := reply.Payload.(MessageNodes); ok && nodes.Found {
+		// The origin replaces copies encrypted under keys rotated since,
+		// which nodes unreachable during the rotation still hold
+		if !h.Origin || nodes.Epoch == s.Keyring.keyEpoch(h.LocalKey) {
+			return nil
+		}
+	}
+
+	// Replicas are forwarded as stored, the origin encrypts its plaintext
+	var b *blob
+	if h.Origin {
+		b, err = s.originBlob(h.LocalKey)
+	} else {
+		b, err = s.replicaBlob(h.ID, h.Key)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = s.pushFile(context.Background(), peer, h.ID, h.Key, b)
+	if !h.Origin {
+		s.dropCorrupted(h.ID, h.Key, err)
+	}
+	return err
+}
+
+// dropCorrupted deletes a replica that failed verification, the nodes
+// holding intact copies restore it when they next rebalance
+func (s *FileServer) dropCorrupted(id string, key string, err error) {
+	if !errors.Is(err, ErrCorrupted) {
+		return
+	}
+
+	log.Printf("[%s] dropping corrupted replica (%s): %s", s.Transport.Addr(), key, err)
+	if err := s.store.Delete(id, key); err != nil {
+		log.Printf("[%s] deleting corrupted replica failed: %s", s.Transport.Addr(), err)
+		return
+	}
+	s.untrack(holding{ID: id, Key: key})
+}
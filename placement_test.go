@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/utkarshgupta2804/p2p-filestorage/p2p"
+)
+
+func TestHashRingOwners(t *testing.T) {
+	ring := newHashRing()
+	nodes := []string{}
+	for i := 0; i < 5; i++ {
+		id := generateID()
+		nodes = append(nodes, id)
+		ring.add(id)
+	}
+
+	owners := ring.owners(SHA256Hash([]byte("picture.png")), 3, nodes[0])
+	if len(owners) != 3 {
+		t.Fatalf("have %d owners want 3", len(owners))
+	}
+
+	seen := map[string]bool{}
+	for _, id := range owners {
+		if id == nodes[0] {
+			t.Errorf("excluded node %s was placed", id)
+		}
+		if seen[id] {
+			t.Errorf("node %s placed twice", id)
+		}
+		seen[id] = true
+	}
+
+	// Asking for more owners than nodes returns every other node
+	if have := len(ring.owners(SHA256Hash([]byte("picture.png")), 10, nodes[0])); have != 4 {
+		t.Errorf("have %d owners want 4", have)
+	}
+}
+
+func TestHashRingMembershipChange(t *testing.T) {
+	ring := newHashRing()
+	for i := 0; i < 10; i++ {
+		ring.add(generateID())
+	}
+
+	before := map[string][]string{}
+	for i := 0; i < 1000; i++ {
+		key := SHA256Hash([]byte(fmt.Sprintf("file_%d", i)))
+		before[key] = ring.owners(key, 1, "")
+	}
+
+	joined := generateID()
+	ring.add(joined)
+
+	// Only keys taken over by the new node change owner
+	moved := 0
+	for key, owners := range before {
+		after := ring.owners(key, 1, "")
+		if after[0] != owners[0] {
+			if after[0] != joined {
+				t.Fatalf("key %s moved between existing nodes", key)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 250 {
+		t.Errorf("have %d of 1000 keys moved, want roughly 1/11", moved)
+	}
+
+	ring.remove(joined)
+	for key, owners := range before {
+		if after := ring.owners(key, 1, ""); after[0] != owners[0] {
+			t.Errorf("key %s did not return to %s after leave", key, owners[0])
+		}
+	}
+}
+
+// namedPeer is a peer that only has a node ID and an address
+type namedPeer struct {
+	p2p.Peer
+	id string
+}
+
+func (p namedPeer) ID() string           { return p.id }
+func (p namedPeer) RemoteAddr() net.Addr { return &net.TCPAddr{} }
+
+func TestRebalanceOnlyWhenPeerRejoins(t *testing.T) {
+	s := NewFileServer(FileServerOpts{Transport: stubTransport{}})
+	rebalanced := func() bool {
+		select {
+		case <-s.rebalancech:
+			return true
+		default:
+			return false
+		}
+	}
+
+	p := namedPeer{id: generateID()}
+	if err := s.OnPeer(p); err != nil {
+		t.Fatal(err)
+	}
+	if rebalanced() {
+		t.Error("rebalanced for a peer connecting the first time")
+	}
+
+	// Back after a disconnect it may have missed files
+	s.OnPeerDisconnect(p)
+	if err := s.OnPeer(p); err != nil {
+		t.Fatal(err)
+	}
+	if !rebalanced() {
+		t.Error("no rebalance for a returning peer")
+	}
+}
+
+func TestRebalanceAfterRestart(t *testing.T) {
+	t.Parallel()
+
+	root := filepath.Join(t.TempDir(), "s1")
+	identity, err := p2p.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := NewKeyring()
+
+	// Store while offline, then come back up as the same node
+	s := NewFileServer(FileServerOpts{
+		Identity:          identity,
+		Keyring:           keyring,
+		StorageRoot:       root,
+		PathTransformFunc: CASPathTransformFunc,
+		Transport:         stubTransport{},
+	})
+	if err := s.Store("picture.png", bytes.NewReader([]byte("stored before the restart"))); err != nil {
+		t.Fatal(err)
+	}
+
+	network := p2p.NewMemoryNetwork()
+	newTransport := func(opts p2p.TCPTransportOpts) *p2p.TCPTransport {
+		return p2p.NewMemoryTransport(network, opts).TCPTransport
+	}
+	s1 := startTestServer(t, root, newTransport, FileServerOpts{Identity: identity, Keyring: keyring})
+
+	// The new peer owns the key on the ring, the file has to reach it
+	s2 := newTestServer(t, network, filepath.Join(t.TempDir(), "s2"), s1.Transport.Addr())
+	waitFor(t, "the file reached s2", func() bool {
+		return s2.store.Has(s1.ID, s1.hashKey("picture.png"))
+	})
+}
+
+func TestRebalanceReplacesOutdatedReplica(t *testing.T) {
+	t.Parallel()
+
+	network := p2p.NewMemoryNetwork()
+	s1 := newTestServer(t, network, filepath.Join(t.TempDir(), "s1"))
+	s2 := newTestServer(t, network, filepath.Join(t.TempDir(), "s2"), s1.Transport.Addr())
+	waitFor(t, "s2 joined", func() bool {
+		_, ok := s1.rt.contact(s2.ID)
+		return ok
+	})
+
+	if err := s1.Store("picture.png", bytes.NewReader([]byte("rotated while s2 was away"))); err != nil {
+		t.Fatal(err)
+	}
+	hashedKey := s1.hashKey("picture.png")
+	if !s2.store.Has(s1.ID, hashedKey) {
+		t.Fatal("file not replicated to s2")
+	}
+
+	// The key was rotated without s2 hearing of it
+	if _, err := s1.Keyring.ReplaceDataKey("picture.png"); err != nil {
+		t.Fatal(err)
+	}
+	s1.rebalance()
+
+	m, err := s2.store.ReadManifest(s1.ID, hashedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Epoch != s1.Keyring.keyEpoch("picture.png") {
+		t.Error("s2 still holds the ciphertext under the old key")
+	}
+
+	// The replaced replica decrypts under the new key
+	if err := s1.store.Delete(s1.ID, "picture.png"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s1.Get("picture.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r); string(b) != "rotated while s2 was away" {
+		t.Errorf("have %q", b)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultReconnectDelay    = 500 * time.Millisecond // First delay before redialing a lost bootstrap node
+	defaultMaxReconnectDelay = time.Minute            // Longest delay between redials
+)
+
+// backoff produces exponentially growing delays with jitter
+type backoff struct {
+	min     time.Duration // Delay after the first failure
+	max     time.Duration // Cap on the delay
+	attempt int           // Failures since the last reset
+	rand    *rand.Rand    // Jitter source
+}
+
+// newBackoff returns a backoff starting at min and doubling up to max
+func newBackoff(min time.Duration, max time.Duration) *backoff {
+	return &backoff{
+		min:  min,
+		max:  max,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// next returns the delay before the next attempt. Up to half of it is
+// random, so nodes that lost the same peer don't redial it in lockstep.
+func (b *backoff) next() time.Duration {
+	d := b.max
+	if b.attempt < 32 {
+		if grown := b.min << b.attempt; grown > 0 && grown < b.max {
+			d = grown
+		}
+	}
+	b.attempt++
+
+	half := d / 2
+	return half + time.Duration(b.rand.Int63n(int64(half)+1))
+}
+
+// reset starts over from the shortest delay
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// disconnected returns a channel closed once the peer with the given node ID
+// is gone, already closed when it isn't connected
+func (s *FileServer) disconnected(id string) <-chan struct{} {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	if done, ok := s.peerDone[id]; ok {
+		return done
+	}
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// pause waits for d, returning false when the server stops first
+func (s *FileServer) pause(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-s.quitch:
+		return false
+	}
+}
+
+// connectBootstrap connects to a bootstrap node and returns its node ID. A
+// node that dialed us first counts as connected, our own dial is only
+// rejected as a duplicate then.
+func (s *FileServer) connectBootstrap(addr string) (string, error) {
+	peer, err := s.connect(addr)
+	var dup *alreadyConnectedError
+	if errors.As(err, &dup) {
+		return dup.id, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return peer.ID(), nil
+}
+
+// keepConnected connects to a bootstrap node and redials it whenever the
+// connection is lost, backing off while it can't be reached, until the
+// server stops
+func (s *FileServer) keepConnected(addr string) {
+	b := newBackoff(s.ReconnectDelay, s.MaxReconnectDelay)
+	id := "" // Node last reached at addr
+
+	for {
+		// The node may have dialed us in the meantime
+		if len(id) == 0 || !s.isConnected(id) {
+			reached, err := s.connectBootstrap(addr)
+			if err != nil {
+				delay := b.next()
+				log.Printf("[%s] connecting to %s failed, retrying in %s: %s", s.Transport.Addr(), addr, delay, err)
+				if !s.pause(delay) {
+					return
+				}
+				continue
+			}
+			id = reached
+			b.reset()
+		}
+
+		select {
+		case <-s.disconnected(id):
+		case <-s.quitch:
+			return
+		}
+
+		// Waiting a little keeps a flapping node from being redialed in a
+		// tight loop
+		delay := b.next()
+		log.Printf("[%s] lost connection with %s, redialing in %s", s.Transport.Addr(), addr, delay)
+		if !s.pause(delay) {
+			return
+		}
+	}
+}
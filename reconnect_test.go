@@ -0,0 +1,80 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/utkarshgupta2804/p2p-filestorage/p2p"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(100*time.Millisecond, time.Second)
+
+	ceiling := 100 * time.Millisecond
+	for i := 0; i < 8; i++ {
+		d := b.next()
+		if d < ceiling/2 || d > ceiling {
+			t.Errorf("attempt %d: have %s want between %s and %s", i, d, ceiling/2, ceiling)
+		}
+		if ceiling < time.Second {
+			ceiling *= 2
+			if ceiling > time.Second {
+				ceiling = time.Second
+			}
+		}
+	}
+
+	b.reset()
+	if d := b.next(); d > 100*time.Millisecond {
+		t.Errorf("have %s after a reset want at most 100ms", d)
+	}
+}
+
+func TestReconnectBootstrapNode(t *testing.T) {
+	t.Parallel()
+
+	network := p2p.NewMemoryNetwork()
+	hub := newTestServer(t, network, filepath.Join(t.TempDir(), "hub"))
+	leaf := newTestServer(t, network, filepath.Join(t.TempDir(), "leaf"), hub.Transport.Addr())
+
+	waitFor(t, "both ends connected", func() bool { return leaf.isConnected(hub.ID) && hub.isConnected(leaf.ID) })
+	first, _ := leaf.peer(hub.ID)
+
+	// Dropping the connection removes the peer on both ends, then the leaf
+	// dials its bootstrap node again
+	inbound, _ := hub.peer(leaf.ID)
+	inbound.Close()
+
+	waitFor(t, "the leaf reconnected", func() bool {
+		p, ok := leaf.peer(hub.ID)
+		return ok && p != first
+	})
+	waitFor(t, "the hub accepted it", func() bool {
+		p, ok := hub.peer(leaf.ID)
+		return ok && p != inbound
+	})
+}
+
+func TestReconnectBootstrapNodeThatDialedFirst(t *testing.T) {
+	t.Parallel()
+
+	network := p2p.NewMemoryNetwork()
+	hub := newTestServer(t, network, filepath.Join(t.TempDir(), "hub"))
+	leaf := newTestServer(t, network, filepath.Join(t.TempDir(), "leaf"))
+
+	if _, err := hub.Transport.Dial(leaf.Transport.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the hub connected", func() bool { return leaf.isConnected(hub.ID) })
+
+	// Dialing the hub back is rejected as a duplicate, which still means
+	// the leaf is connected to it
+	id, err := leaf.connectBootstrap(hub.Transport.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != hub.ID {
+		t.Errorf("have node %s want %s", id, hub.ID)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+)
+
+// rotationStage is how far the re-encryption of a compromised file got
+type rotationStage int
+
+const (
+	rotationPending rotationStage = iota // Still under the compromised key
+	rotationRekeyed                      // New key recorded, replicas not updated yet
+	rotationDone                         // Replicas hold the new ciphertext
+)
+
+// rotationJournal records an ongoing key rotation so an interrupted one
+// resumes where it stopped
+type rotationJournal struct {
+	MasterRotated bool                     // Keys are wrapped under the new master key
+	SecretRotated bool                     `json:",omitempty"` // Chunk keys derive from the new secret
+	Files         map[string]rotationStage // Files to re-encrypt by key
+}
+
+// RotationProgress reports how far a key rotation got
+type RotationProgress struct {
+	Key   string // File just re-encrypted
+	Done  int    // Files re-encrypted and pushed to their replicas
+	Total int    // Files to re-encrypt
+}
+
+// journalPath returns where the rotation journal is kept, next to the keyring
+func (s *FileServer) journalPath() string {
+	if len(s.Keyring.path) == 0 {
+		return ""
+	}
+	return s.Keyring.path + ".rotation"
+}
+
+// loadJournal returns the journal of an interrupted rotation, or a new one
+func (s *FileServer) loadJournal() (*rotationJournal, error) {
+	j := &rotationJournal{Files: make(map[string]rotationStage)}
+	if len(s.journalPath()) == 0 {
+		return j, nil
+	}
+
+	b, err := os.ReadFile(s.journalPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, j); err != nil {
+		return nil, fmt.Errorf("rotation journal: %w", err)
+	}
+	if j.Files == nil {
+		j.Files = make(map[string]rotationStage)
+	}
+	return j, nil
+}
+
+// saveJournal persists the journal
+func (s *FileServer) saveJournal(j *rotationJournal) error {
+	if len(s.journalPath()) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.journalPath(), b)
+}
+
+// RotateKeys wraps all file keys under a new master key. Files whose data
+// keys are listed as compromised get new keys, and their new ciphertext is
+// pushed to the nodes holding them. Progress is journaled next to the
+// keyring, calling RotateKeys again after an interruption resumes the
+// rotation, and progress is called after each re-encrypted file.
+//
+// The secret chunk keys are derived from is kept, so whoever learned it can
+// still decrypt the chunks of every other file, RotateSecret replaces it.
+// Nodes unreachable during the rotation keep the old ciphertext until this
+// node's next rebalance finds their copy outdated and replaces it.
+func (s *FileServer) RotateKeys(ctx context.Context, compromised []string, progress func(RotationProgress)) error {
+	j, err := s.loadJournal()
+	if err != nil {
+		return err
+	}
+	for _, key := range compromised {
+		if _, ok := j.Files[key]; !ok {
+			j.Files[key] = rotationPending
+		}
+	}
+
+	if !j.MasterRotated {
+		// Journal the files first, so they are re-encrypted even if we
+		// stop right after the new master key is saved
+		if err := s.saveJournal(j); err != nil {
+			return err
+		}
+		if err := s.Keyring.RotateMaster(); err != nil {
+			return err
+		}
+		j.MasterRotated = true
+		if err := s.saveJournal(j); err != nil {
+			return err
+		}
+		log.Printf("[%s] rotated master key", s.Transport.Addr())
+	}
+
+	return s.reencryptAll(ctx, j, progress)
+}
+
+// RotateSecret replaces the secret chunk keys are derived from, for when it
+// leaked, and encrypts every file this node holds again. The new ciphertext
+// is pushed to the nodes holding the files. It is journaled and resumed like
+// RotateKeys, which it can be resumed with as well. Files stored from here
+// but no longer held locally can't be listed, and keep their old chunk keys.
+func (s *FileServer) RotateSecret(ctx context.Context, progress func(RotationProgress)) error {
+	j, err := s.loadJournal()
+	if err != nil {
+		return err
+	}
+
+	if !j.SecretRotated {
+		// The new secret alone changes the chunk keys, the data keys stay
+		for _, f := range s.store.List(s.ID, "") {
+			if stage, ok := j.Files[f.Key]; !ok || stage == rotationDone {
+				j.Files[f.Key] = rotationRekeyed
+			}
+		}
+		if err := s.saveJournal(j); err != nil {
+			return err
+		}
+		if err := s.Keyring.RotateSecret(); err != nil {
+			return err
+		}
+		j.SecretRotated = true
+		if err := s.saveJournal(j); err != nil {
+			return err
+		}
+		log.Printf("[%s] rotated convergence secret", s.Transport.Addr())
+	}
+
+	return s.reencryptAll(ctx, j, progress)
+}
+
+// reencryptAll re-encrypts the journaled files not done yet, and removes the
+// journal once all are
+func (s *FileServer) reencryptAll(ctx context.Context, j *rotationJournal, progress func(RotationProgress)) error {
+	keys := make([]string, 0, len(j.Files))
+	done := 0
+	for key, stage := range j.Files {
+		if stage == rotationDone {
+			done++
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var firstErr error
+	for _, key := range keys {
+		if err := s.reencrypt(ctx, j, key); err != nil {
+			log.Printf("[%s] re-encrypting (%s) failed: %s", s.Transport.Addr(), key, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+
+		done++
+		if progress != nil {
+			progress(RotationProgress{Key: key, Done: done, Total: len(j.Files)})
+		}
+	}
+	if firstErr != nil {
+		return firstErr // The journal keeps the failed files for the next run
+	}
+
+	if len(s.journalPath()) > 0 {
+		if err := os.Remove(s.journalPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// reencrypt moves a file to new chunk keys, with a new data key while still
+// pending, and replaces the ciphertext on the nodes holding it
+func (s *FileServer) reencrypt(ctx context.Context, j *rotationJournal, key string) error {
+	// Only the plaintext can be encrypted again, fetch it while the old
+	// key still decrypts the replicas
+	if !s.store.Has(s.ID, key) {
+		r, err := s.GetContext(ctx, key)
+		if err != nil {
+			return err
+		}
+		if rc, ok := r.(io.ReadCloser); ok {
+			rc.Close()
+		}
+	}
+
+	if j.Files[key] == rotationPending {
+		if _, err := s.Keyring.ReplaceDataKey(key); err != nil {
+			return err
+		}
+		j.Files[key] = rotationRekeyed
+		if err := s.saveJournal(j); err != nil {
+			return err
+		}
+	}
+
+	b, err := s.originBlob(key)
+	if err != nil {
+		return err
+	}
+
+	// Replace the copies wherever they are, not only on the current owners
+	hashedKey := s.hashKey(key)
+	_, holders := s.lookup(ctx, keyNodeID(hashedKey), &MessageFindValue{ID: s.ID, Key: hashedKey})
+	targets := map[string]bool{}
+	for _, c := range holders {
+		targets[c.ID] = true
+	}
+	for _, id := range s.ring.owners(hashedKey, s.ReplicationFactor, s.ID) {
+		targets[id] = true
+	}
+
+	for id := range targets {
+		c, ok := s.rt.contact(id)
+		if !ok {
+			return fmt.Errorf("no contact for node %s", id)
+		}
+		peer, err := s.dialContact(c)
+		if err != nil {
+			return err
+		}
+		if _, err := s.pushFile(ctx, peer, s.ID, hashedKey, b); err != nil {
+			return fmt.Errorf("push to %s: %w", id, err)
+		}
+	}
+
+	j.Files[key] = rotationDone
+	return s.saveJournal(j)
+}
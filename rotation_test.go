@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newRotationServer(t *testing.T) *FileServer {
+	dir := t.TempDir()
+	keyring, err := OpenKeyring(filepath.Join(dir, "keyring.json"), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewFileServer(FileServerOpts{
+		Keyring:           keyring,
+		StorageRoot:       filepath.Join(dir, "store"),
+		PathTransformFunc: CASPathTransformFunc,
+		Transport:         stubTransport{},
+	})
+	for _, key := range []string{"safe.bin", "leaked.bin"} {
+		if err := s.Store(key, bytes.NewReader([]byte("build artifact"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestRotateKeys(t *testing.T) {
+	s := newRotationServer(t)
+
+	before := map[string]*blob{}
+	for _, key := range []string{"safe.bin", "leaked.bin"} {
+		b, err := s.originBlob(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before[key] = b
+	}
+	safeKey, _ := s.Keyring.DataKey("safe.bin")
+
+	reports := []RotationProgress{}
+	err := s.RotateKeys(context.Background(), []string{"leaked.bin"}, func(p RotationProgress) {
+		reports = append(reports, p)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].Done != 1 || reports[0].Total != 1 {
+		t.Errorf("have progress %+v want a single report of 1/1", reports)
+	}
+
+	// Untouched files keep their keys, compromised ones are encrypted anew
+	if have, _ := s.Keyring.DataKey("safe.bin"); !bytes.Equal(have, safeKey) {
+		t.Error("data key of an uncompromised file changed")
+	}
+	for key, changed := range map[string]bool{"safe.bin": false, "leaked.bin": true} {
+		b, err := s.originBlob(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := b.manifest.Chunks[0].Hash != before[key].manifest.Chunks[0].Hash; have != changed {
+			t.Errorf("%s: have ciphertext changed %v want %v", key, have, changed)
+		}
+	}
+
+	if _, err := os.Stat(s.journalPath()); !os.IsNotExist(err) {
+		t.Error("journal left behind after a completed rotation")
+	}
+	if _, err := OpenKeyring(s.Keyring.path, "secret"); err != nil {
+		t.Errorf("keyring doesn't open after rotation: %s", err)
+	}
+}
+
+func TestRotateKeysResumes(t *testing.T) {
+	s := newRotationServer(t)
+
+	// A previous run stopped after giving the file a new key
+	if _, err := s.Keyring.ReplaceDataKey("leaked.bin"); err != nil {
+		t.Fatal(err)
+	}
+	newKey, _ := s.Keyring.DataKey("leaked.bin")
+	err := s.saveJournal(&rotationJournal{
+		MasterRotated: true,
+		Files:         map[string]rotationStage{"leaked.bin": rotationRekeyed},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := 0
+	if err := s.RotateKeys(context.Background(), nil, func(RotationProgress) { done++ }); err != nil {
+		t.Fatal(err)
+	}
+	if done != 1 {
+		t.Errorf("have %d files finished want 1", done)
+	}
+	if have, _ := s.Keyring.DataKey("leaked.bin"); !bytes.Equal(have, newKey) {
+		t.Error("resumed rotation replaced the data key again")
+	}
+}
+
+func TestRotateSecret(t *testing.T) {
+	s := newRotationServer(t)
+
+	before := map[string]*blob{}
+	for _, key := range []string{"safe.bin", "leaked.bin"} {
+		b, err := s.originBlob(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before[key] = b
+	}
+
+	done := 0
+	if err := s.RotateSecret(context.Background(), func(RotationProgress) { done++ }); err != nil {
+		t.Fatal(err)
+	}
+	if done != 2 {
+		t.Errorf("have %d files re-encrypted want 2", done)
+	}
+
+	// Every file gets new chunk keys, without a new data key
+	for key, b := range before {
+		after, err := s.originBlob(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if after.manifest.Chunks[0].Hash == b.manifest.Chunks[0].Hash {
+			t.Errorf("%s: ciphertext unchanged", key)
+		}
+		if after.manifest.Epoch == b.manifest.Epoch {
+			t.Errorf("%s: epoch unchanged", key)
+		}
+	}
+
+	if _, err := os.Stat(s.journalPath()); !os.IsNotExist(err) {
+		t.Error("journal left behind after a completed rotation")
+	}
+	if _, err := OpenKeyring(s.Keyring.path, "secret"); err != nil {
+		t.Errorf("keyring doesn't open after rotation: %s", err)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/utkarshgupta2804/p2p-filestorage/p2p"
+)
+
+const (
+	rpcTimeout = 5 * time.Second  // Deadline for a single request/response exchange
+	getTimeout = 30 * time.Second // Deadline for fetching a file from the network
+)
+
+// ErrNotFound is returned when no reachable node holds a requested file
+var ErrNotFound = errors.New("not found on the network")
+
+// ErrPeerGone is returned for requests to a peer that disconnected before
+// answering
+var ErrPeerGone = errors.New("peer disconnected")
+
+// response is a reply delivered to a pending request
+type response struct {
+	from   string     // Node ID of the responder
+	msg    *Message   // Reply message
+	stream p2p.Stream // Set when the reply carries data
+	err    error      // Set instead of msg when the responder is gone
+}
+
+// pendingRequest collects the replies to a request sent to one or more peers
+type pendingRequest struct {
+	id        uint64
+	peers     map[string]bool // Nodes yet to answer, guarded by pendingLock
+	responses chan response
+}
+
+// newRequest registers a request expecting up to n replies
+func (s *FileServer) newRequest(n int) *pendingRequest {
+	req := &pendingRequest{
+		id:        atomic.AddUint64(&s.nextRequestID, 1),
+		peers:     make(map[string]bool),
+		responses: make(chan response, n),
+	}
+
+	s.pendingLock.Lock()
+	s.pending[req.id] = req
+	s.pendingLock.Unlock()
+
+	return req
+}
+
+// finishRequest unregisters a request and aborts replies nobody will read
+func (s *FileServer) finishRequest(req *pendingRequest) {
+	s.pendingLock.Lock()
+	delete(s.pending, req.id)
+	s.pendingLock.Unlock()
+
+	for {
+		select {
+		case res := <-req.responses:
+			if res.stream != nil {
+				res.stream.Reset()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// sendRequest sends payload to peer as part of req
+func (s *FileServer) sendRequest(peer p2p.Peer, req *pendingRequest, payload any) error {
+	s.pendingLock.Lock()
+	req.peers[peer.ID()] = true
+	s.pendingLock.Unlock()
+
+	msg := s.message(payload)
+	msg.ID = req.id
+
+	b, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	return peer.Send(b)
+}
+
+// deliver hands a reply to the request it answers. Late replies to finished
+// requests are dropped quietly, replies from nodes the request wasn't sent
+// to are rejected.
+func (s *FileServer) deliver(from string, msg *Message, stream p2p.Stream) error {
+	var err error
+
+	s.pendingLock.Lock()
+	req, ok := s.pending[msg.ReplyTo]
+	switch {
+	case !ok:
+	case !req.peers[from]:
+		err = fmt.Errorf("[%s] unsolicited reply to request %d from %s", s.Transport.Addr(), msg.ReplyTo, from)
+	default:
+		select {
+		case req.responses <- response{from: from, msg: msg, stream: stream}:
+			stream = nil // Handed over to the requester
+			delete(req.peers, from)
+		default:
+			err = fmt.Errorf("[%s] too many replies to request %d", s.Transport.Addr(), msg.ReplyTo)
+		}
+	}
+	s.pendingLock.Unlock()
+
+	if stream != nil {
+		stream.Reset()
+	}
+
+	return err
+}
+
+// abandonRequests fails the requests still awaiting a reply from a node
+// that disconnected, so they don't wait for it until their deadline
+func (s *FileServer) abandonRequests(id string) {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+
+	for _, req := range s.pending {
+		if !req.peers[id] {
+			continue
+		}
+		delete(req.peers, id)
+		select {
+		case req.responses <- response{from: id, err: ErrPeerGone}:
+		default:
+		}
+	}
+}
+
+// call sends a request to a single peer and waits for its reply
+func (s *FileServer) call(ctx context.Context, peer p2p.Peer, payload any) (*Message, error) {
+	req := s.newRequest(1)
+	defer s.finishRequest(req)
+
+	if err := s.sendRequest(peer, req, payload); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-req.responses:
+		if res.err != nil {
+			return nil, res.err
+		}
+		if res.stream != nil {
+			res.stream.Reset()
+		}
+		return res.msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// callContact dials a known node and sends it a request, waiting up to
+// rpcTimeout for the reply
+func (s *FileServer) callContact(ctx context.Context, c Contact, payload any) (*Message, error) {
+	peer, err := s.dialContact(c)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rpcTimeout)
+	defer cancel()
+
+	return s.call(ctx, peer, payload)
+}
+
+// respond answers request id from the given node with a regular message
+func (s *FileServer) respond(to string, id uint64, payload any) error {
+	peer, ok := s.peer(to)
+	if !ok {
+		return fmt.Errorf("[%s] peer %s not connected", s.Transport.Addr(), to)
+	}
+
+	msg := s.message(payload)
+	msg.ReplyTo = id
+
+	b, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	return peer.Send(b)
+}
+
+// resetOnDone aborts the stream when ctx ends; the returned func stops watching
+func resetOnDone(ctx context.Context, stream p2p.Stream) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.Reset()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/utkarshgupta2804/p2p-filestorage/p2p"
+)
+
+// stubTransport satisfies p2p.Transport for tests that never touch the network
+type stubTransport struct{}
+
+func (stubTransport) Addr() string                  { return ":0" }
+func (stubTransport) Dial(string) (p2p.Peer, error) { return nil, errors.New("stub transport") }
+func (stubTransport) ListenAndAccept() error        { return nil }
+func (stubTransport) Consume() <-chan p2p.RPC       { return nil }
+func (stubTransport) Close() error                  { return nil }
+
+func TestPendingRequestDelivery(t *testing.T) {
+	s := NewFileServer(FileServerOpts{Transport: stubTransport{}})
+
+	req := s.newRequest(1)
+	s.pendingLock.Lock()
+	req.peers["alice"] = true
+	s.pendingLock.Unlock()
+
+	// Only nodes the request was sent to may answer it
+	if err := s.deliver("mallory", &Message{ReplyTo: req.id}, nil); err == nil {
+		t.Error("expected unsolicited reply to be rejected")
+	}
+	if err := s.deliver("alice", &Message{ReplyTo: req.id, Payload: MessageGetFileResponse{}}, nil); err != nil {
+		t.Error(err)
+	}
+
+	select {
+	case res := <-req.responses:
+		if res.from != "alice" {
+			t.Errorf("have reply from %s want alice", res.from)
+		}
+	default:
+		t.Fatal("reply was not delivered")
+	}
+
+	// Late replies to finished requests are dropped quietly
+	s.finishRequest(req)
+	if err := s.deliver("alice", &Message{ReplyTo: req.id}, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	s := NewFileServer(FileServerOpts{Transport: stubTransport{}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// The request is sent but never answered
+	_, err := s.call(ctx, silentPeer{}, MessageFindNode{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("have %v want deadline exceeded", err)
+	}
+	if len(s.pending) != 0 {
+		t.Errorf("have %d pending requests want 0", len(s.pending))
+	}
+}
+
+func TestCallPeerGone(t *testing.T) {
+	s := NewFileServer(FileServerOpts{Transport: stubTransport{}})
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s.call(context.Background(), silentPeer{}, MessageFindNode{})
+		errc <- err
+	}()
+	waitFor(t, "the request was sent", func() bool {
+		s.pendingLock.Lock()
+		defer s.pendingLock.Unlock()
+		for _, req := range s.pending {
+			return req.peers["silent"]
+		}
+		return false
+	})
+
+	// The peer disconnecting fails the request without waiting for a deadline
+	s.abandonRequests("silent")
+	select {
+	case err := <-errc:
+		if err != ErrPeerGone {
+			t.Errorf("have %v want %v", err, ErrPeerGone)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request still waiting")
+	}
+}
+
+// silentPeer accepts every message and never answers
+type silentPeer struct{ p2p.Peer }
+
+func (silentPeer) ID() string        { return "silent" }
+func (silentPeer) Send([]byte) error { return nil }
@@ -2,8 +2,9 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -15,23 +16,47 @@ import (
 
 // FileServerOpts contains configuration options for FileServer
 type FileServerOpts struct {
-	ID                string            // Server identifier
-	EncKey            []byte            // Encryption key
+	ID                string            // Server identifier, derived from Identity when set
+	Identity          *p2p.Identity     // Persistent node key pair
+	Keyring           *Keyring          // Per-file encryption keys
 	StorageRoot       string            // Root storage directory
 	PathTransformFunc PathTransformFunc // Path transformation function
+	KeyHash           HashFunc          // Names files on the network, SHA-256 by default
 	Transport         p2p.Transport     // Network transport
 	BootstrapNodes    []string          // Initial nodes to connect to
+	ReplicationFactor int               // Peers holding a copy of each file
+	ReconnectDelay    time.Duration     // First delay before redialing a lost bootstrap node
+	MaxReconnectDelay time.Duration     // Longest delay between redials
+	TargetPeers       int               // Connections kept up with peers from the address book
+	PEXInterval       time.Duration     // Time between peer exchanges
 }
 
 // FileServer implements the P2P file storage server
 type FileServer struct {
 	FileServerOpts
 
-	peerLock sync.Mutex          // Protects peers map
-	peers    map[string]p2p.Peer // Connected peers
+	peerLock sync.Mutex               // Protects peers, peerDone and departed
+	peers    map[string]p2p.Peer      // Connected peers by node ID
+	peerDone map[string]chan struct{} // Closed once the peer disconnects
+	departed map[string]bool          // Node IDs of peers that disconnected
 
-	store  *Store        // Storage backend
-	quitch chan struct{} // Channel for graceful shutdown
+	rt   *routingTable // Kademlia routing table
+	ring *hashRing     // Consistent hashing ring placing files on peers
+
+	pendingLock   sync.Mutex                 // Protects pending
+	pending       map[uint64]*pendingRequest // Requests awaiting replies by ID
+	nextRequestID uint64                     // Last request ID handed out
+
+	holdLock    sync.Mutex         // Protects holdings
+	holdings    map[string]holding // Local files subject to rebalancing
+	rebalancech chan struct{}      // Signals membership changes
+
+	book  *addressBook  // Known peers, persisted to rejoin without bootstrap nodes
+	pexch chan struct{} // Signals peers were heard of
+
+	store      *Store        // Storage backend
+	tombstones *tombstones   // Files deleted from the network
+	quitch     chan struct{} // Channel for graceful shutdown
 }
 
 // NewFileServer creates a new FileServer instance
@@ -41,45 +66,132 @@ func NewFileServer(opts FileServerOpts) *FileServer {
 		PathTransformFunc: opts.PathTransformFunc,
 	}
 
+	if opts.Identity != nil {
+		opts.ID = opts.Identity.ID() // Node ID is the public key
+	}
 	if len(opts.ID) == 0 {
 		opts.ID = generateID() // Generate unique ID if not provided
 	}
+	if opts.Keyring == nil {
+		opts.Keyring = NewKeyring() // Files can't be decrypted after a restart
+	}
+	if opts.KeyHash == nil {
+		opts.KeyHash = SHA256Hash // All nodes of a network must agree on it
+	}
+	if opts.ReplicationFactor <= 0 {
+		opts.ReplicationFactor = defaultReplicationFactor
+	}
+	if opts.ReconnectDelay <= 0 {
+		opts.ReconnectDelay = defaultReconnectDelay
+	}
+	if opts.MaxReconnectDelay < opts.ReconnectDelay {
+		opts.MaxReconnectDelay = defaultMaxReconnectDelay
+	}
+	if opts.TargetPeers <= 0 {
+		opts.TargetPeers = defaultTargetPeers
+	}
+	if opts.PEXInterval <= 0 {
+		opts.PEXInterval = defaultPEXInterval
+	}
+
+	ring := newHashRing()
+	ring.add(opts.ID)
+
+	store := NewStore(storeOpts)
+	deleted, err := loadTombstones(tombstonePath(store.Root))
+	if err != nil {
+		// Keep the broken file for inspection rather than overwriting it
+		log.Printf("loading tombstones failed, deletions won't persist: %s", err)
+		deleted = newTombstones("")
+	}
+	book, err := loadAddressBook(addressBookPath(store.Root), opts.ID)
+	if err != nil {
+		log.Printf("loading address book failed, known peers won't persist: %s", err)
+		book = newAddressBook("", opts.ID)
+	}
 
-	return &FileServer{
+	s := &FileServer{
 		FileServerOpts: opts,
-		store:          NewStore(storeOpts),
+		store:          store,
+		tombstones:     deleted,
 		quitch:         make(chan struct{}),
 		peers:          make(map[string]p2p.Peer),
+		peerDone:       make(map[string]chan struct{}),
+		departed:       make(map[string]bool),
+		rt:             newRoutingTable(toNodeID(opts.ID)),
+		ring:           ring,
+		pending:        make(map[uint64]*pendingRequest),
+		holdings:       make(map[string]holding),
+		rebalancech:    make(chan struct{}, 1),
+		book:           book,
+		pexch:          make(chan struct{}, 1),
 	}
+	s.loadHoldings() // Files stored before a restart keep their replicas
+
+	return s
 }
 
-// broadcast sends a message to all connected peers
-func (s *FileServer) broadcast(msg *Message) error {
+// hashKey returns the name a file is known by on the network
+func (s *FileServer) hashKey(key string) string {
+	return s.KeyHash([]byte(key))
+}
+
+// message wraps a payload with the sender's advertised listen address
+func (s *FileServer) message(payload any) *Message {
+	return &Message{
+		Addr:    s.Transport.Addr(),
+		Payload: payload,
+	}
+}
+
+// encodeMessage gob-encodes a message for the wire
+func encodeMessage(msg *Message) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// broadcast sends a message to all connected peers
+func (s *FileServer) broadcast(msg *Message) error {
+	b, err := encodeMessage(msg)
+	if err != nil {
 		return err
 	}
 
+	s.peerLock.Lock()
+	peers := make([]p2p.Peer, 0, len(s.peers))
 	for _, peer := range s.peers {
-		peer.Send([]byte{p2p.IncomingMessage}) // Message type indicator
-		if err := peer.Send(buf.Bytes()); err != nil {
-			return err
+		peers = append(peers, peer)
+	}
+	s.peerLock.Unlock()
+
+	// A peer dropping mid-broadcast doesn't keep the others from the message
+	var sendErr error
+	for _, peer := range peers {
+		if err := peer.Send(b); err != nil {
+			sendErr = fmt.Errorf("[%s] sending to %s: %w", s.Transport.Addr(), peer.ID(), err)
 		}
 	}
 
-	return nil
+	return sendErr
 }
 
 // Message represents a network message
 type Message struct {
-	Payload any // Can be any serializable type
+	ID      uint64 // Request ID, zero when no reply is expected
+	ReplyTo uint64 // ID of the request this message answers
+	Addr    string // Sender's advertised listen address
+	Payload any    // Can be any serializable type
 }
 
-// MessageStoreFile contains file storage information
+// MessageStoreFile offers a file to a peer. It is the header of a stream on
+// which the peer requests the chunks it lacks and then receives them.
 type MessageStoreFile struct {
-	ID   string // File owner ID
-	Key  string // File key
-	Size int64  // File size
+	ID       string   // File owner ID
+	Key      string   // File key
+	Manifest Manifest // Encrypted chunks making up the file
 }
 
 // MessageGetFile contains file retrieval information
@@ -88,94 +200,200 @@ type MessageGetFile struct {
 	Key string // File key
 }
 
+// MessageGetFileResponse answers MessageGetFile. When the file was found it
+// is the header of a stream carrying the file's chunks.
+type MessageGetFileResponse struct {
+	Found    bool     // Responder holds the file
+	Manifest Manifest // Encrypted chunks following on the stream
+}
+
 // Get retrieves a file by key, either locally or from the network
 func (s *FileServer) Get(key string) (io.Reader, error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext is Get with a context bounding the network fetch
+func (s *FileServer) GetContext(ctx context.Context, key string) (io.Reader, error) {
 	// Check local storage first
 	if s.store.Has(s.ID, key) {
 		fmt.Printf("[%s] serving file (%s) from local disk\n", s.Transport.Addr(), key)
 		_, r, err := s.store.Read(s.ID, key)
 		return r, err
 	}
+	if _, ok := s.tombstones.covers(s.ID, s.hashKey(key), 0); ok {
+		return nil, ErrDeleted
+	}
 
 	fmt.Printf("[%s] dont have file (%s) locally, fetching from network...\n", s.Transport.Addr(), key)
 
-	// Create and broadcast get request
-	msg := Message{
-		Payload: MessageGetFile{
+	ctx, cancel := context.WithTimeout(ctx, getTimeout)
+	defer cancel()
+
+	// Ask the nodes the ring places the file on, then fall back to the DHT
+	owners := []Contact{}
+	for _, id := range s.ring.owners(s.hashKey(key), s.ReplicationFactor, s.ID) {
+		if c, ok := s.rt.contact(id); ok {
+			owners = append(owners, c)
+		}
+	}
+
+	err := s.fetchFile(ctx, owners, key)
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrCorrupted) {
+		_, holders := s.lookup(ctx, keyNodeID(s.hashKey(key)), &MessageFindValue{
 			ID:  s.ID,
-			Key: hashKey(key),
-		},
+			Key: s.hashKey(key),
+		})
+		err = s.fetchFile(ctx, holders, key)
 	}
-	if err := s.broadcast(&msg); err != nil {
-		return nil, err
+	if err != nil {
+		return nil, fmt.Errorf("[%s] get (%s): %w", s.Transport.Addr(), key, err)
 	}
 
-	time.Sleep(time.Millisecond * 500) // Wait for responses
+	// Return the now locally stored file
+	_, r, err := s.store.Read(s.ID, key)
+	return r, err
+}
 
-	// Receive file from peers
-	for _, peer := range s.peers {
-		var fileSize int64
-		binary.Read(peer, binary.LittleEndian, &fileSize)
+// fetchFile asks every contact for the file at once and writes the first
+// valid response decrypted to disk
+func (s *FileServer) fetchFile(ctx context.Context, contacts []Contact, key string) error {
+	req := s.newRequest(len(contacts))
+	defer s.finishRequest(req)
 
-		// Write and decrypt the received file
-		n, err := s.store.WriteDecrypt(s.EncKey, s.ID, key, io.LimitReader(peer, fileSize))
+	sent, corrupted := 0, error(nil)
+	for _, c := range contacts {
+		peer, err := s.dialContact(c)
 		if err != nil {
-			return nil, err
+			log.Printf("[%s] dial %s failed: %s", s.Transport.Addr(), c.Addr, err)
+			continue
+		}
+		if err := s.sendRequest(peer, req, MessageGetFile{ID: s.ID, Key: s.hashKey(key)}); err != nil {
+			log.Printf("[%s] get request to %s failed: %s", s.Transport.Addr(), c.Addr, err)
+			continue
 		}
+		sent++
+	}
+
+	for answered := 0; answered < sent; answered++ {
+		select {
+		case res := <-req.responses:
+			if res.err != nil {
+				log.Printf("[%s] fetch from %s failed: %s", s.Transport.Addr(), res.from, res.err)
+				continue
+			}
+			resp, ok := res.msg.Payload.(MessageGetFileResponse)
+			if !ok || !resp.Found || res.stream == nil {
+				if res.stream != nil {
+					res.stream.Reset()
+				}
+				continue
+			}
+
+			// Write and decrypt the received file, every chunk is verified
+			dec, err := s.newChunkDecrypter(key, &resp.Manifest, res.stream)
+			if err == nil {
+				stop := resetOnDone(ctx, res.stream)
+				var n int64
+				n, err = s.store.WriteContext(ctx, s.ID, key, dec)
+				stop()
+				if err == nil {
+					res.stream.Close()
+					fmt.Printf("[%s] received (%d) bytes over the network from (%s)\n", s.Transport.Addr(), n, res.from)
+					return nil
+				}
+			}
+			res.stream.Reset()
 
-		fmt.Printf("[%s] received (%d) bytes over the network from (%s)", s.Transport.Addr(), n, peer.RemoteAddr())
+			log.Printf("[%s] fetch from %s failed: %s", s.Transport.Addr(), res.from, err)
+			if errors.Is(err, ErrCorrupted) {
+				corrupted = err
+			}
 
-		peer.CloseStream()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 
-	// Return the now locally stored file
-	_, r, err := s.store.Read(s.ID, key)
-	return r, err
+	if corrupted != nil {
+		return corrupted
+	}
+	return ErrNotFound
 }
 
 // Store saves a file locally and propagates it to the network
 func (s *FileServer) Store(key string, r io.Reader) error {
-	var (
-		fileBuffer = new(bytes.Buffer)
-		tee        = io.TeeReader(r, fileBuffer) // Tee reader to write and keep data
-	)
+	return s.StoreContext(context.Background(), key, r)
+}
 
-	// Store locally first
-	size, err := s.store.Write(s.ID, key, tee)
+// StoreContext is Store with a context bounding the local write and the
+// transfer to peers. Cancelled transfers are reset, so peers drop what they
+// received so far.
+func (s *FileServer) StoreContext(ctx context.Context, key string, r io.Reader) error {
+	// Store locally first, peers are then fed from disk so memory use
+	// doesn't grow with the file size
+	size, err := s.store.WriteContext(ctx, s.ID, key, r)
 	if err != nil {
 		return err
 	}
+	s.track(holding{ID: s.ID, Key: s.hashKey(key), LocalKey: key, Origin: true})
+	if err := s.tombstones.remove(s.ID, s.hashKey(key)); err != nil {
+		return err
+	}
+
+	fmt.Printf("[%s] written (%d) bytes of (%s) to disk\n", s.Transport.Addr(), size, key)
 
-	// Broadcast storage info to network
-	msg := Message{
-		Payload: MessageStoreFile{
-			ID:   s.ID,
-			Key:  hashKey(key),
-			Size: size + 16, // Account for IV in encrypted data
-		},
+	// Discover the key's neighbourhood, then place the file on the ring
+	s.lookup(ctx, keyNodeID(s.hashKey(key)), nil)
+	owners := s.ring.owners(s.hashKey(key), s.ReplicationFactor, s.ID)
+	if len(owners) == 0 {
+		return nil
 	}
 
-	if err := s.broadcast(&msg); err != nil {
+	b, err := s.originBlob(key)
+	if err != nil {
 		return err
 	}
 
-	time.Sleep(time.Millisecond * 5)
+	// Offer the file to the responsible peers, each only receives the
+	// chunks it doesn't hold yet
+	var (
+		wg   sync.WaitGroup
+		errc = make(chan error, len(owners))
+	)
+	for _, id := range owners {
+		c, ok := s.rt.contact(id)
+		if !ok {
+			continue
+		}
+		peer, err := s.dialContact(c)
+		if err != nil {
+			log.Printf("[%s] dial %s failed: %s", s.Transport.Addr(), c.Addr, err)
+			continue
+		}
 
-	// Stream file to all peers
-	peers := []io.Writer{}
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
+		wg.Add(1)
+		go func(peer p2p.Peer) {
+			defer wg.Done()
+			n, err := s.pushFile(ctx, peer, s.ID, s.hashKey(key), b)
+			if err != nil {
+				errc <- err
+				return
+			}
+			fmt.Printf("[%s] sent (%d) bytes of (%s) to %s\n", s.Transport.Addr(), n, key, peer.ID())
+		}(peer)
 	}
-	mw := io.MultiWriter(peers...)
-	mw.Write([]byte{p2p.IncomingStream}) // Stream type indicator
-	n, err := copyEncrypt(s.EncKey, fileBuffer, mw)
-	if err != nil {
+	wg.Wait()
+	close(errc)
+
+	if err := ctx.Err(); err != nil {
 		return err
 	}
+	return <-errc
+}
 
-	fmt.Printf("[%s] received and written (%d) bytes to disk\n", s.Transport.Addr(), n)
-
-	return nil
+// Delete removes a file stored under key from this node and the network
+func (s *FileServer) Delete(key string) error {
+	return s.DeleteContext(context.Background(), key)
 }
 
 // Stop shuts down the file server
@@ -188,13 +406,53 @@ func (s *FileServer) OnPeer(p p2p.Peer) error {
 	s.peerLock.Lock()
 	defer s.peerLock.Unlock()
 
-	s.peers[p.RemoteAddr().String()] = p
+	if _, ok := s.peers[p.ID()]; ok {
+		return &alreadyConnectedError{addr: s.Transport.Addr(), id: p.ID()}
+	}
+	s.peers[p.ID()] = p
+	s.peerDone[p.ID()] = make(chan struct{})
+
+	log.Printf("connected with remote %s (%s)", p.RemoteAddr(), p.ID())
 
-	log.Printf("connected with remote %s", p.RemoteAddr())
+	// A returning peer may have missed files stored while it was away
+	if s.departed[p.ID()] {
+		delete(s.departed, p.ID())
+		s.scheduleRebalance()
+	}
 
 	return nil
 }
 
+// alreadyConnectedError rejects a second connection with a node. It names
+// the node, so a dialer racing the node's own dial learns who it reached.
+type alreadyConnectedError struct {
+	addr string // Our listen address
+	id   string // Node ID of the peer
+}
+
+func (e *alreadyConnectedError) Error() string {
+	return fmt.Sprintf("[%s] already connected with %s", e.addr, e.id)
+}
+
+// OnPeerDisconnect forgets a peer whose connection is gone
+func (s *FileServer) OnPeerDisconnect(p p2p.Peer) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	// A newer connection with the same node stays
+	if s.peers[p.ID()] != p {
+		return
+	}
+	delete(s.peers, p.ID())
+	close(s.peerDone[p.ID()])
+	delete(s.peerDone, p.ID())
+	s.departed[p.ID()] = true
+
+	log.Printf("disconnected from remote %s (%s)", p.RemoteAddr(), p.ID())
+
+	s.abandonRequests(p.ID())
+}
+
 // loop is the main event loop for the file server
 func (s *FileServer) loop() {
 	defer func() {
@@ -208,7 +466,41 @@ func (s *FileServer) loop() {
 			var msg Message
 			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
 				log.Println("decoding error: ", err)
+				if rpc.Stream != nil {
+					rpc.Stream.Reset()
+				}
+				continue
+			}
+
+			s.observe(rpc.From, msg.Addr)
+
+			if msg.ReplyTo != 0 {
+				if err := s.deliver(rpc.From, &msg, rpc.Stream); err != nil {
+					log.Println("deliver reply error: ", err)
+				}
+				continue
+			}
+
+			// Streams and requests are served concurrently so a long
+			// transfer doesn't block the loop
+			if rpc.Stream != nil {
+				go func(rpc p2p.RPC) {
+					if err := s.handleStream(rpc.From, &msg, rpc.Stream); err != nil {
+						log.Println("handle stream error: ", err)
+					}
+				}(rpc)
+				continue
+			}
+
+			if msg.ID != 0 {
+				go func(from string) {
+					if err := s.handleMessage(from, &msg); err != nil {
+						log.Println("handle message error: ", err)
+					}
+				}(rpc.From)
+				continue
 			}
+
 			if err := s.handleMessage(rpc.From, &msg); err != nil {
 				log.Println("handle message error: ", err)
 			}
@@ -222,42 +514,73 @@ func (s *FileServer) loop() {
 // handleMessage processes incoming messages
 func (s *FileServer) handleMessage(from string, msg *Message) error {
 	switch v := msg.Payload.(type) {
-	case MessageStoreFile:
-		return s.handleMessageStoreFile(from, v)
 	case MessageGetFile:
-		return s.handleMessageGetFile(from, v)
+		return s.handleMessageGetFile(from, msg.ID, v)
+	case MessageFindNode:
+		return s.handleMessageFindNode(from, msg.ID, v)
+	case MessageFindValue:
+		return s.handleMessageFindValue(from, msg.ID, v)
+	case MessageDeleteFile:
+		return s.handleMessageDeleteFile(from, msg.ID, v)
+	case MessageListFiles:
+		return s.handleMessageListFiles(from, msg.ID, v)
+	case MessageStatFile:
+		return s.handleMessageStatFile(from, msg.ID, v)
+	case MessagePeerExchange:
+		return s.handleMessagePeerExchange(from, msg.ID, v)
 	}
 
-	return nil
+	return fmt.Errorf("unexpected message %T from %s", msg.Payload, from)
+}
+
+// handleStream processes streams opened by peers, the stream header is msg
+func (s *FileServer) handleStream(from string, msg *Message, stream p2p.Stream) error {
+	defer stream.Close()
+
+	switch v := msg.Payload.(type) {
+	case MessageStoreFile:
+		return s.handleMessageStoreFile(from, v, stream)
+	}
+
+	return fmt.Errorf("unexpected stream %T from %s", msg.Payload, from)
 }
 
 // handleMessageGetFile processes file retrieval requests
-func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
-	if !s.store.Has(msg.ID, msg.Key) {
-		return fmt.Errorf("[%s] need to serve file (%s) but it does not exist on disk", s.Transport.Addr(), msg.Key)
+func (s *FileServer) handleMessageGetFile(from string, id uint64, msg MessageGetFile) error {
+	b, err := s.replicaBlob(msg.ID, msg.Key)
+	if err != nil {
+		return s.respond(from, id, MessageGetFileResponse{Found: false})
 	}
 
 	fmt.Printf("[%s] serving file (%s) over the network\n", s.Transport.Addr(), msg.Key)
 
-	fileSize, r, err := s.store.Read(msg.ID, msg.Key)
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	// The response is the header of the stream carrying the file
+	reply := s.message(MessageGetFileResponse{Found: true, Manifest: *b.manifest})
+	reply.ReplyTo = id
+	header, err := encodeMessage(reply)
 	if err != nil {
 		return err
 	}
 
-	if rc, ok := r.(io.ReadCloser); ok {
-		defer rc.Close()
+	stream, err := peer.OpenStream(header)
+	if err != nil {
+		return err
 	}
+	defer stream.Close()
 
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer %s not in map", from)
+	all := make([]int, len(b.manifest.Chunks))
+	for i := range all {
+		all[i] = i
 	}
-
-	// Send stream indicator and file size
-	peer.Send([]byte{p2p.IncomingStream})
-	binary.Write(peer, binary.LittleEndian, fileSize)
-	n, err := io.Copy(peer, r)
+	n, err := b.writeChunks(stream, all)
 	if err != nil {
+		stream.Reset()
+		s.dropCorrupted(msg.ID, msg.Key, err)
 		return err
 	}
 
@@ -266,44 +589,82 @@ func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error
 	return nil
 }
 
-// handleMessageStoreFile processes file storage notifications
-func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error {
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+// handleMessageStoreFile processes file storage offers
+func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile, stream p2p.Stream) error {
+	// A node that missed the deletion of the file is told instead
+	if deletion, ok := s.tombstones.covers(msg.ID, msg.Key, msg.Manifest.Created); ok {
+		b, err := encodeMessage(s.message(deletion))
+		if err != nil {
+			return err
+		}
+		_, err = stream.Write(b)
+		return err
 	}
 
-	// Write the incoming file data
-	n, err := s.store.Write(msg.ID, msg.Key, io.LimitReader(peer, msg.Size))
+	// Ask for the chunks we lack, the file is only recorded once all arrived
+	var n int
+	err := s.store.WriteManifest(msg.ID, msg.Key, &msg.Manifest, func(missing []int) (io.Reader, error) {
+		n = len(missing)
+		b, err := encodeMessage(s.message(MessageChunkRequest{Missing: missing}))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := stream.Write(b); err != nil {
+			return nil, err
+		}
+		return stream, nil
+	})
 	if err != nil {
-		return err
+		stream.Reset()
+		return fmt.Errorf("[%s] store (%s) from %s: %w", s.Transport.Addr(), msg.Key, from, err)
 	}
 
-	fmt.Printf("[%s] written %d bytes to disk\n", s.Transport.Addr(), n)
+	fmt.Printf("[%s] written (%s) to disk, %d of %d chunks were new\n", s.Transport.Addr(), msg.Key, n, len(msg.Manifest.Chunks))
 
-	peer.CloseStream()
+	if err := s.tombstones.remove(msg.ID, msg.Key); err != nil {
+		return err
+	}
+
+	s.track(holding{ID: msg.ID, Key: msg.Key, LocalKey: msg.Key})
 
 	return nil
 }
 
-// bootstrapNetwork connects to initial nodes
+// bootstrapNetwork connects to initial nodes, staying connected to them
 func (s *FileServer) bootstrapNetwork() error {
 	for _, addr := range s.BootstrapNodes {
 		if len(addr) == 0 {
 			continue
 		}
 
-		go func(addr string) {
-			fmt.Printf("[%s] attemping to connect with remote %s\n", s.Transport.Addr(), addr)
-			if err := s.Transport.Dial(addr); err != nil {
-				log.Println("dial error: ", err)
-			}
-		}(addr)
+		go s.keepConnected(addr)
 	}
 
 	return nil
 }
 
+// connect dials a bootstrap node and joins the network through it
+func (s *FileServer) connect(addr string) (p2p.Peer, error) {
+	fmt.Printf("[%s] attemping to connect with remote %s\n", s.Transport.Addr(), addr)
+	peer, err := s.Transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	c := Contact{ID: peer.ID(), Addr: contactAddr(addr, peer.RemoteAddr())}
+	s.addContact(c)
+
+	// Looking ourselves up announces us to the network and fills
+	// the routing table with our neighbourhood
+	s.lookup(context.Background(), toNodeID(s.ID), nil)
+
+	// Tell the node about our peers and learn about its own
+	if err := s.exchangePeers(context.Background(), c); err != nil {
+		log.Printf("[%s] peer exchange with %s failed: %s", s.Transport.Addr(), addr, err)
+	}
+
+	return peer, nil
+}
+
 // Start begins the file server operation
 func (s *FileServer) Start() error {
 	fmt.Printf("[%s] starting fileserver...\n", s.Transport.Addr())
@@ -314,6 +675,9 @@ func (s *FileServer) Start() error {
 
 	s.bootstrapNetwork() // Connect to initial nodes
 
+	go s.rebalanceLoop() // Move files when peers join or leave
+	go s.pexLoop()       // Share peers and keep enough of them connected
+
 	s.loop() // Start main event loop
 
 	return nil
@@ -323,4 +687,5 @@ func init() {
 	// Register message types for gob encoding
 	gob.Register(MessageStoreFile{})
 	gob.Register(MessageGetFile{})
+	gob.Register(MessageGetFileResponse{})
 }
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/utkarshgupta2804/p2p-filestorage/p2p"
+)
+
+// zeroReader is an endless source of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// BenchmarkStore shows Store streams the file, allocated bytes per
+// operation stay far below the file size and only grow with the manifest
+func BenchmarkStore(b *testing.B) {
+	for _, size := range []int64{1 << 20, 16 << 20, 64 << 20} {
+		b.Run(fmt.Sprintf("%dMB", size>>20), func(b *testing.B) {
+			s := NewFileServer(FileServerOpts{
+				StorageRoot:       b.TempDir(),
+				PathTransformFunc: CASPathTransformFunc,
+				Transport:         stubTransport{},
+			})
+
+			b.ReportAllocs()
+			b.SetBytes(size)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := s.Store("big_file", io.LimitReader(zeroReader{}, size)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreStreamsLargeFile(t *testing.T) {
+	network := p2p.NewMemoryNetwork()
+	s1 := newTestServer(t, network, filepath.Join(t.TempDir(), "s1"))
+	s2 := newTestServer(t, network, filepath.Join(t.TempDir(), "s2"), s1.Transport.Addr())
+	waitFor(t, "s2 joined", func() bool {
+		_, ok := s1.rt.contact(s2.ID)
+		return ok
+	})
+
+	// Sample the heap while a file far larger than a chunk or a stream
+	// window is stored and replicated
+	const size = 64 << 20
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	base, peak := stats.HeapAlloc, stats.HeapAlloc
+
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > peak {
+				peak = stats.HeapAlloc
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+
+	err := s1.Store("big_file", io.LimitReader(rand.New(rand.NewSource(1)), size))
+	close(done)
+	<-sampled
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s2.store.Has(s1.ID, s1.hashKey("big_file")) {
+		t.Fatal("file not replicated to s2")
+	}
+
+	// A handful of chunks and windows in flight, plus garbage not collected
+	// yet, but nothing growing with the file
+	if growth := peak - base; growth > size/4 {
+		t.Errorf("heap grew by %d MB storing a %d MB file", growth>>20, size>>20)
+	}
+}
+
+// newTestServer starts a server storing under root on an in-memory
+// network, listening at the root's base name
+func newTestServer(t *testing.T, network *p2p.MemoryNetwork, root string, bootstrap ...string) *FileServer {
+	newTransport := func(opts p2p.TCPTransportOpts) *p2p.TCPTransport {
+		return p2p.NewMemoryTransport(network, opts).TCPTransport
+	}
+	return startTestServer(t, root, newTransport, FileServerOpts{BootstrapNodes: bootstrap})
+}
+
+// startTestServer starts a server storing under root on the transport
+// newTransport creates, listening at the root's base name. Options left
+// unset in opts get a new identity and short delays suiting tests.
+func startTestServer(t *testing.T, root string, newTransport func(p2p.TCPTransportOpts) *p2p.TCPTransport, opts FileServerOpts) *FileServer {
+	if opts.Identity == nil {
+		identity, err := p2p.NewIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.Identity = identity
+	}
+	tr := newTransport(p2p.TCPTransportOpts{
+		ListenAddr:    filepath.Base(root) + ":1",
+		HandshakeFunc: p2p.IdentityHandshakeFunc(opts.Identity),
+	})
+
+	opts.StorageRoot = root
+	opts.PathTransformFunc = CASPathTransformFunc
+	opts.Transport = tr
+	if opts.ReconnectDelay == 0 {
+		opts.ReconnectDelay = 10 * time.Millisecond
+	}
+	if opts.MaxReconnectDelay == 0 {
+		opts.MaxReconnectDelay = 50 * time.Millisecond
+	}
+	if opts.PEXInterval == 0 {
+		opts.PEXInterval = 50 * time.Millisecond
+	}
+	s := NewFileServer(opts)
+	tr.OnPeer = s.OnPeer
+	tr.OnPeerDisconnect = s.OnPeerDisconnect
+
+	if err := tr.ListenAndAccept(); err != nil {
+		t.Fatal(err)
+	}
+	s.bootstrapNetwork()
+	go s.rebalanceLoop()
+	go s.pexLoop()
+	go s.loop()
+	t.Cleanup(s.Stop)
+
+	return s
+}
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestStoreAndGetOverNetwork(t *testing.T) {
+	t.Parallel()
+
+	network := p2p.NewMemoryNetwork()
+	s1 := newTestServer(t, network, filepath.Join(t.TempDir(), "s1"))
+	s2 := newTestServer(t, network, filepath.Join(t.TempDir(), "s2"))
+	s3 := newTestServer(t, network, filepath.Join(t.TempDir(), "s3"), s1.Transport.Addr(), s2.Transport.Addr())
+	waitFor(t, "s3 joined", func() bool {
+		_, ok1 := s3.rt.contact(s1.ID)
+		_, ok2 := s3.rt.contact(s2.ID)
+		return ok1 && ok2
+	})
+
+	if err := s3.Store("picture.png", bytes.NewReader([]byte("my big data file here!"))); err != nil {
+		t.Fatal(err)
+	}
+	if !s1.store.Has(s3.ID, s3.hashKey("picture.png")) || !s2.store.Has(s3.ID, s3.hashKey("picture.png")) {
+		t.Error("file not replicated to s1 and s2")
+	}
+
+	// Lose the local copy, the replicas bring it back
+	if err := s3.store.Delete(s3.ID, "picture.png"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s3.Get("picture.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r); string(b) != "my big data file here!" {
+		t.Errorf("have %q", b)
+	}
+}
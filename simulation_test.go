@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/utkarshgupta2804/p2p-filestorage/p2p"
+)
+
+// simFile is a file stored in a simulation
+type simFile struct {
+	origin *FileServer
+	data   []byte
+}
+
+// simCluster is a set of file servers on a simulated network whose clock
+// runs as fast as the servers keep up
+type simCluster struct {
+	t       *testing.T
+	network *p2p.SimNetwork
+	nodes   []*FileServer
+	files   map[string]simFile // By key
+}
+
+// newSimCluster starts n servers with the given replication factor, every
+// link following rule, and waits until they are all connected
+func newSimCluster(t *testing.T, seed int64, n int, replication int, rule p2p.LinkRule) *simCluster {
+	dir := t.TempDir()
+	network := p2p.NewSimNetwork(seed)
+	network.SetDefaultLink(rule)
+	quit := make(chan struct{})
+	go network.Clock.Run(quit)
+
+	newTransport := func(opts p2p.TCPTransportOpts) *p2p.TCPTransport {
+		// Heartbeats run on the network's clock, so they have to outlast
+		// the slowest link of a scenario like on a real network
+		opts.HeartbeatInterval = time.Second
+		opts.HeartbeatMisses = 5
+		return p2p.NewSimTransport(network, opts).TCPTransport
+	}
+
+	c := &simCluster{t: t, network: network, files: make(map[string]simFile)}
+	// Freezes the network once the servers stopped, before dir is removed
+	t.Cleanup(func() { close(quit) })
+
+	for i := 0; i < n; i++ {
+		opts := FileServerOpts{ReplicationFactor: replication}
+		if i > 0 {
+			opts.BootstrapNodes = []string{c.nodes[0].Transport.Addr()}
+		}
+		root := filepath.Join(dir, fmt.Sprintf("node%d", i))
+		c.nodes = append(c.nodes, startTestServer(t, root, newTransport, opts))
+	}
+	c.waitConnected()
+
+	return c
+}
+
+// addr returns the address of node i
+func (c *simCluster) addr(i int) string {
+	return c.nodes[i].Transport.Addr()
+}
+
+// node returns the server with the given ID
+func (c *simCluster) node(id string) *FileServer {
+	for _, s := range c.nodes {
+		if s.ID == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// waitConnected waits until every node is connected to every other and
+// placing files on all of them
+func (c *simCluster) waitConnected() {
+	waitFor(c.t, "the cluster is fully connected", func() bool {
+		for _, a := range c.nodes {
+			for _, b := range c.nodes {
+				if a == b {
+					continue
+				}
+				if _, ok := a.rt.contact(b.ID); !ok || !a.isConnected(b.ID) {
+					return false
+				}
+			}
+		}
+		return true
+	})
+}
+
+// store stores size random bytes under key on node i
+func (c *simCluster) store(i int, key string, size int) {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(len(c.files)))).Read(data)
+
+	if err := c.nodes[i].Store(key, bytes.NewReader(data)); err != nil {
+		c.t.Fatalf("storing %s on node%d: %s", key, i, err)
+	}
+	c.files[key] = simFile{origin: c.nodes[i], data: data}
+}
+
+// replicaIntact reports whether s holds a complete copy of a file, every
+// chunk reading back with its recorded hash and size
+func replicaIntact(s *FileServer, id string, key string) bool {
+	m, err := s.store.ReadManifest(id, key)
+	if err != nil {
+		return false
+	}
+	for _, ref := range m.Chunks {
+		b, err := s.store.ReadChunk(ref.Hash)
+		if err != nil || int64(len(b)) != ref.Size {
+			return false
+		}
+	}
+	return true
+}
+
+// assertDurable checks the durability invariants of every stored file:
+// each node the origin places it on holds an intact replica, and the
+// origin gets the same bytes back from the network after losing its copy
+func (c *simCluster) assertDurable() {
+	for key, f := range c.files {
+		hashed := f.origin.hashKey(key)
+		owners := f.origin.ring.owners(hashed, f.origin.ReplicationFactor, f.origin.ID)
+		if len(owners) != f.origin.ReplicationFactor {
+			c.t.Fatalf("%s placed on %d nodes, want %d", key, len(owners), f.origin.ReplicationFactor)
+		}
+
+		waitFor(c.t, key+" is replicated", func() bool {
+			for _, id := range owners {
+				if !replicaIntact(c.node(id), f.origin.ID, hashed) {
+					return false
+				}
+			}
+			return true
+		})
+
+		if err := f.origin.store.Delete(f.origin.ID, key); err != nil {
+			c.t.Fatal(err)
+		}
+		r, err := f.origin.Get(key)
+		if err != nil {
+			c.t.Fatalf("getting %s back: %s", key, err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if !bytes.Equal(b, f.data) {
+			c.t.Errorf("%s came back changed", key)
+		}
+	}
+}
+
+func TestSimulationFaultyLinks(t *testing.T) {
+	t.Parallel()
+
+	c := newSimCluster(t, 1, 5, 3, p2p.LinkRule{
+		Latency:   20 * time.Millisecond,
+		Jitter:    30 * time.Millisecond,
+		Loss:      0.05,
+		Bandwidth: 1 << 20,
+	})
+	// One direction barely gets through
+	c.network.SetLink(c.addr(1), c.addr(2), p2p.LinkRule{Latency: 100 * time.Millisecond, Loss: 0.5, Bandwidth: 64 << 10})
+
+	c.store(0, "a.bin", 200<<10)
+	c.store(1, "b.bin", 50<<10)
+	c.store(3, "c.bin", 1<<10)
+
+	c.assertDurable()
+}
+
+func TestSimulationPartitionHeals(t *testing.T) {
+	t.Parallel()
+
+	c := newSimCluster(t, 2, 5, 3, p2p.LinkRule{Latency: 10 * time.Millisecond, Jitter: 10 * time.Millisecond})
+
+	minority := []string{c.addr(0), c.addr(1)}
+	majority := []string{c.addr(2), c.addr(3), c.addr(4)}
+	c.network.Partition(minority, majority)
+	waitFor(t, "heartbeats notice the partition", func() bool {
+		for _, a := range c.nodes[:2] {
+			for _, b := range c.nodes[2:] {
+				if a.isConnected(b.ID) || b.isConnected(a.ID) {
+					return false
+				}
+			}
+		}
+		return true
+	})
+
+	// Both sides keep taking writes, reaching only their own side
+	c.store(0, "minority.bin", 100<<10)
+	c.store(3, "majority.bin", 100<<10)
+
+	c.network.Heal()
+	c.waitConnected()
+	c.assertDurable()
+}
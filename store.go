@@ -1,37 +1,69 @@
 package main
 
 import (
-    "crypto/sha1"
+    "bytes"
+    "context"
+    "crypto/sha256"
     "encoding/hex"
+    "encoding/json"
     "errors"
     "fmt"
     "io"
     "log"
     "os"
+    "path/filepath"
+    "runtime"
     "strings"
+    "sync"
+    "time"
 )
 
-const defaultRootFolderName = "p2pnetwork" // Default storage directory
+const (
+    defaultRootFolderName = "p2pnetwork" // Default storage directory
+    chunkFolderName       = "chunks"     // Directory under the root holding chunks
+)
 
-// CASPathTransformFunc creates a content-addressable storage path
-func CASPathTransformFunc(key string) PathKey {
-    hash := sha1.Sum([]byte(key))           // SHA1 hash of key
-    hashStr := hex.EncodeToString(hash[:]) // Hex encoded hash
+const (
+    defaultFanOutDepth = 2 // Directory levels above each manifest and chunk
+    defaultFanOutWidth = 2 // Hex characters naming each level
+)
 
-    blocksize := 5
-    sliceLen := len(hashStr) / blocksize
-    paths := make([]string, sliceLen)
+// CASPathTransformFunc creates a content-addressable storage path from the
+// SHA-256 of the key, two directory levels deep
+var CASPathTransformFunc = NewCASPathTransformFunc(SHA256Hash, defaultFanOutDepth, defaultFanOutWidth)
+
+// LegacyPathTransformFunc is the layout of earlier releases, the SHA-1 of the
+// key split into eight directories of five characters. MigrateStore moves
+// storage roots written with it to the current layout.
+var LegacyPathTransformFunc = NewCASPathTransformFunc(SHA1Hash, 8, 5)
+
+// NewCASPathTransformFunc creates a content-addressable path transform naming
+// files by the hash of their key, nested depth directories deep with each
+// directory named by the next width characters of the hash
+func NewCASPathTransformFunc(hash HashFunc, depth int, width int) PathTransformFunc {
+    return func(key string) PathKey {
+        hashStr := hash([]byte(key))
+        return PathKey{
+            PathName: fanOut(hashStr, depth, width), // Directory path
+            Filename: hashStr,                       // Filename
+        }
+    }
+}
 
-    // Split hash into blocks for directory structure
-    for i := 0; i < sliceLen; i++ {
-        from, to := i*blocksize, (i*blocksize)+blocksize
-        paths[i] = hashStr[from:to]
+// fanOut splits the start of a hash into directory names
+func fanOut(hash string, depth int, width int) string {
+    if width <= 0 {
+        return ""
+    }
+    if depth > len(hash)/width {
+        depth = len(hash) / width
     }
 
-    return PathKey{
-        PathName: strings.Join(paths, "/"), // Directory path
-        Filename: hashStr,                 // Filename
+    paths := make([]string, 0, depth)
+    for i := 0; i < depth; i++ {
+        paths = append(paths, hash[i*width:(i+1)*width])
     }
+    return strings.Join(paths, "/")
 }
 
 // PathTransformFunc defines how to transform keys to storage paths
@@ -54,6 +86,9 @@ func (p PathKey) FirstPathName() string {
 
 // FullPath returns the complete path including filename
 func (p PathKey) FullPath() string {
+    if len(p.PathName) == 0 {
+        return p.Filename
+    }
     return fmt.Sprintf("%s/%s", p.PathName, p.Filename)
 }
 
@@ -61,6 +96,9 @@ func (p PathKey) FullPath() string {
 type StoreOpts struct {
     Root              string            // Root storage directory
     PathTransformFunc PathTransformFunc // Function to transform keys to paths
+    Hash              HashFunc          // Names files by key hash when PathTransformFunc is unset
+    FanOutDepth       int               // Directory levels above each hashed path, 2 by default
+    FanOutWidth       int               // Hex characters naming each level, 2 by default
 }
 
 // DefaultPathTransformFunc is a simple path transform that uses the key directly
@@ -71,13 +109,63 @@ var DefaultPathTransformFunc = func(key string) PathKey {
     }
 }
 
-// Store manages file storage operations
+// ErrCorrupted is returned when data doesn't match the hash it is addressed by
+var ErrCorrupted = errors.New("data corrupted")
+
+// CorruptedError reports a chunk that failed verification, it matches
+// ErrCorrupted with errors.Is
+type CorruptedError struct {
+    Hash string // Hash the chunk is addressed by
+}
+
+func (e *CorruptedError) Error() string {
+    return fmt.Sprintf("chunk %s: %s", e.Hash, ErrCorrupted)
+}
+
+// Is reports whether target is ErrCorrupted
+func (e *CorruptedError) Is(target error) bool {
+    return target == ErrCorrupted
+}
+
+// ChunkRef identifies a chunk by the SHA-256 of its contents
+type ChunkRef struct {
+    Hash string // Hex encoded SHA-256 of the chunk
+    Size int64  // Chunk length in bytes
+}
+
+// Manifest lists the chunks making up a stored file
+type Manifest struct {
+    Size    int64      // Total file size
+    Chunks  []ChunkRef // Chunks in file order
+    Keys    []byte     // Sealed chunk keys, kept with encrypted files
+    Key     string     `json:",omitempty"` // Key the file is stored under, recorded locally
+    Created int64      `json:",omitempty"` // Unix nanoseconds when the origin stored the file
+    Epoch   string     `json:",omitempty"` // Identifies the chunk keys of an encrypted file
+}
+
+// Store manages file storage operations. Files are split into content-defined
+// chunks kept once under the root, and each key holds a manifest of its chunks,
+// so content shared between files is only stored once.
 type Store struct {
     StoreOpts
+
+    lock sync.RWMutex // Keeps chunk garbage collection from racing writes
+
+    indexOnce sync.Once
+    index     *storeIndex // Keys of stored files, loaded on first use
 }
 
 // NewStore creates a new Store instance
 func NewStore(opts StoreOpts) *Store {
+    if opts.FanOutDepth <= 0 {
+        opts.FanOutDepth = defaultFanOutDepth
+    }
+    if opts.FanOutWidth <= 0 {
+        opts.FanOutWidth = defaultFanOutWidth
+    }
+    if opts.PathTransformFunc == nil && opts.Hash != nil {
+        opts.PathTransformFunc = NewCASPathTransformFunc(opts.Hash, opts.FanOutDepth, opts.FanOutWidth)
+    }
     if opts.PathTransformFunc == nil {
         opts.PathTransformFunc = DefaultPathTransformFunc
     }
@@ -90,6 +178,17 @@ func NewStore(opts StoreOpts) *Store {
     }
 }
 
+// manifestPath returns where the manifest for the given ID and key lives
+func (s *Store) manifestPath(id string, key string) string {
+    pathKey := s.PathTransformFunc(key)
+    return fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+}
+
+// chunkPath returns where the chunk with the given hash lives
+func (s *Store) chunkPath(hash string) string {
+    return fmt.Sprintf("%s/%s/%s/%s", s.Root, chunkFolderName, fanOut(hash, s.FanOutDepth, s.FanOutWidth), hash)
+}
+
 // Has checks if a file exists for the given ID and key
 func (s *Store) Has(id string, key string) bool {
     pathKey := s.PathTransformFunc(key)
@@ -101,57 +200,415 @@ func (s *Store) Has(id string, key string) bool {
 
 // Clear removes all stored files
 func (s *Store) Clear() error {
+    s.loadIndex().reset()
     return os.RemoveAll(s.Root)
 }
 
-// Delete removes a file by ID and key
+// Delete removes a file by ID and key, along with chunks no other file uses
 func (s *Store) Delete(id string, key string) error {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+
     pathKey := s.PathTransformFunc(key)
 
     defer func() {
         log.Printf("deleted [%s] from disk", pathKey.Filename)
     }()
 
-    firstPathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FirstPathName())
+    m, _ := s.readManifest(id, key)
 
-    return os.RemoveAll(firstPathNameWithRoot)
+    // Only the file goes, other keys may share its directories
+    path := s.manifestPath(id, key)
+    if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+        return err
+    }
+    s.pruneEmptyDirs(filepath.Dir(path))
+    if err := s.loadIndex().remove(id, key); err != nil {
+        return err
+    }
+
+    if m == nil {
+        return nil
+    }
+    return s.collectChunks(m.Chunks)
+}
+
+// pruneEmptyDirs removes dir and its parents up to the root while they are
+// empty
+func (s *Store) pruneEmptyDirs(dir string) {
+    for {
+        rel, err := filepath.Rel(s.Root, dir)
+        if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+            return // Reached the root
+        }
+        if err := os.Remove(dir); err != nil {
+            return // Not empty, so neither are its parents
+        }
+        dir = filepath.Dir(dir)
+    }
+}
+
+// collectChunks removes the given chunks unless an indexed file still
+// uses them
+func (s *Store) collectChunks(chunks []ChunkRef) error {
+    idx := s.loadIndex()
+    removed := map[string]bool{}
+    for _, c := range chunks {
+        if removed[c.Hash] || idx.used(c.Hash) {
+            continue
+        }
+        removed[c.Hash] = true // Only remove once
+        if err := os.Remove(s.chunkPath(c.Hash)); err != nil && !errors.Is(err, os.ErrNotExist) {
+            return err
+        }
+        s.pruneEmptyDirs(filepath.Dir(s.chunkPath(c.Hash)))
+    }
+
+    return nil
 }
 
 // Write stores data for the given ID and key
 func (s *Store) Write(id string, key string, r io.Reader) (int64, error) {
-    return s.writeStream(id, key, r)
+    return s.WriteContext(context.Background(), id, key, r)
+}
+
+// WriteContext stores data for the given ID and key, giving up with
+// ctx.Err() once ctx is cancelled
+func (s *Store) WriteContext(ctx context.Context, id string, key string, r io.Reader) (int64, error) {
+    return s.writeStream(id, key, &contextReader{ctx: ctx, r: r})
 }
 
-// WriteDecrypt writes and decrypts data using the provided encryption key
-func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
+// WriteManifest stores a file whose chunks may partly be held already. fetch
+// is called once with the indexes of the chunks that are missing and returns
+// their contents back to back. Each chunk is verified against its hash.
+func (s *Store) WriteManifest(id string, key string, m *Manifest, fetch func(missing []int) (io.Reader, error)) error {
+    for _, c := range m.Chunks {
+        if !validChunkHash(c.Hash) || c.Size < 0 || c.Size > maxChunkSize+chunkOverhead {
+            return fmt.Errorf("invalid chunk %q of size %d", c.Hash, c.Size)
+        }
+    }
+
+    old, written, err := s.putManifest(id, key, m, fetch)
+    if err != nil {
+        s.collectUnused(written)
+        return err
+    }
+    s.collectReplaced(old)
+
+    return nil
+}
+
+// putManifest stores the missing chunks and the manifest, returning the
+// manifest it replaced and the chunks it stored. A failed write still
+// returns the chunks stored, for the caller to collect.
+func (s *Store) putManifest(id string, key string, m *Manifest, fetch func(missing []int) (io.Reader, error)) (*Manifest, []ChunkRef, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+
+    missing := []int{}
+    wanted := map[string]bool{}
+    for i, c := range m.Chunks {
+        if !wanted[c.Hash] && !s.hasChunk(c.Hash) {
+            wanted[c.Hash] = true
+            missing = append(missing, i)
+        }
+    }
+
+    r, err := fetch(missing)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    written := []ChunkRef{}
+    for _, i := range missing {
+        c := m.Chunks[i]
+        b := make([]byte, c.Size)
+        if _, err := io.ReadFull(r, b); err != nil {
+            return nil, written, err
+        }
+        ref, created, err := s.putChunk(b)
+        if err != nil {
+            return nil, written, err
+        }
+        if created {
+            written = append(written, ref)
+        }
+        if ref.Hash != c.Hash {
+            return nil, written, fmt.Errorf("chunk %s arrived with hash %s", c.Hash, ref.Hash)
+        }
+    }
+
+    old, _ := s.readManifest(id, key)
+    return old, written, s.writeManifest(id, key, m)
+}
+
+// collectReplaced removes the chunks of an overwritten manifest that are no
+// longer used
+func (s *Store) collectReplaced(old *Manifest) {
+    if old == nil {
+        return
+    }
+    s.collectUnused(old.Chunks)
+}
+
+// collectUnused removes the given chunks unless a file uses them. It waits
+// for the writes in progress, which may be about to use them.
+func (s *Store) collectUnused(chunks []ChunkRef) {
+    if len(chunks) == 0 {
+        return
+    }
+
+    s.lock.Lock()
+    defer s.lock.Unlock()
+
+    if err := s.collectChunks(chunks); err != nil {
+        log.Printf("collecting unused chunks failed: %s", err)
+    }
+}
+
+// ReadManifest returns the manifest stored for the given ID and key
+func (s *Store) ReadManifest(id string, key string) (*Manifest, error) {
+    return s.readManifest(id, key)
+}
+
+// ReadChunk returns the contents of a chunk, verified against its hash. A
+// corrupted chunk is removed, so it is fetched again the next time a file
+// using it is written.
+func (s *Store) ReadChunk(hash string) ([]byte, error) {
+    if !validChunkHash(hash) {
+        return nil, fmt.Errorf("invalid chunk hash %q", hash)
+    }
+
+    b, err := os.ReadFile(s.chunkPath(hash))
+    if err != nil {
+        return nil, err
+    }
+    if sum := sha256.Sum256(b); hex.EncodeToString(sum[:]) != hash {
+        log.Printf("removing corrupted chunk [%s]", hash)
+        os.Remove(s.chunkPath(hash))
+        return nil, &CorruptedError{Hash: hash}
+    }
+
+    return b, nil
+}
+
+// validChunkHash reports whether hash is a hex encoded SHA-256, so it can't
+// escape the chunk directory
+func validChunkHash(hash string) bool {
+    b, err := hex.DecodeString(hash)
+    return err == nil && len(b) == sha256.Size
+}
+
+// hasChunk reports whether a chunk is stored
+func (s *Store) hasChunk(hash string) bool {
+    _, err := os.Stat(s.chunkPath(hash))
+    return err == nil
+}
+
+// putChunk stores a chunk unless it is already held, and reports whether it
+// was stored
+func (s *Store) putChunk(b []byte) (ChunkRef, bool, error) {
+    sum := sha256.Sum256(b)
+    ref := ChunkRef{Hash: hex.EncodeToString(sum[:]), Size: int64(len(b))}
+    if s.hasChunk(ref.Hash) {
+        return ref, false, nil
+    }
+
+    f, err := createAtomic(s.chunkPath(ref.Hash))
+    if err != nil {
+        return ref, false, err
+    }
+    _, err = f.Write(b)
+    return ref, true, s.finishWrite(f, err)
+}
+
+// writeManifest records the chunks making up a file, along with its key. The
+// index learns of the manifest before it is written, so a crash in between
+// can't leave a file the index doesn't know about.
+func (s *Store) writeManifest(id string, key string, m *Manifest) error {
+    idx := s.loadIndex()
+    info, chunks := s.fileInfo(id, key, m), chunkHashes(m)
+    if err := idx.prepare(info, chunks); err != nil {
+        return err
+    }
+
     f, err := s.openFileForWriting(id, key)
+    if err == nil {
+        record := *m
+        record.Key = key
+        err = s.finishWrite(f, json.NewEncoder(f).Encode(&record))
+    }
+    idx.commit(info, chunks, err == nil)
+    return err
+}
+
+// readManifest loads the manifest for the given ID and key
+func (s *Store) readManifest(id string, key string) (*Manifest, error) {
+    return loadManifest(s.manifestPath(id, key))
+}
+
+// loadManifest parses a manifest file
+func loadManifest(path string) (*Manifest, error) {
+    b, err := os.ReadFile(path)
     if err != nil {
+        return nil, err
+    }
+    m := &Manifest{}
+    if err := json.Unmarshal(b, m); err != nil {
+        return nil, err
+    }
+    return m, nil
+}
+
+// contextReader fails reads once its context is done
+type contextReader struct {
+    ctx context.Context
+    r   io.Reader
+}
+
+func (cr *contextReader) Read(b []byte) (int, error) {
+    if err := cr.ctx.Err(); err != nil {
         return 0, err
     }
-    n, err := copyDecrypt(encKey, r, f)
-    return int64(n), err
+    return cr.r.Read(b)
+}
+
+// finishWrite moves a written file into place, or discards it when the
+// write failed so no half-written file is left behind
+func (s *Store) finishWrite(f *atomicFile, err error) error {
+    if err != nil {
+        f.Abort()
+        return err
+    }
+    return f.Commit()
 }
 
-// openFileForWriting prepares a file for writing
-func (s Store) openFileForWriting(id string, key string) (*os.File, error) {
+// openFileForWriting prepares a file for writing, it replaces whatever the
+// key holds once the write is finished
+func (s *Store) openFileForWriting(id string, key string) (*atomicFile, error) {
     pathKey := s.PathTransformFunc(key)
-    pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.PathName)
-    if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
+    fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+
+    return createAtomic(fullPathWithRoot)
+}
+
+// atomicFile is written under a temporary name next to its destination and
+// renamed over it when complete, so after a crash or a failed transfer
+// readers find either the old contents or the new ones, never part of them
+type atomicFile struct {
+    *os.File
+    path string // Destination
+}
+
+// createAtomic starts writing the file at path
+func createAtomic(path string) (*atomicFile, error) {
+    dir := filepath.Dir(path)
+    if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+        return nil, err
+    }
+    f, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+    if err != nil {
         return nil, err
     }
+    return &atomicFile{File: f, path: path}, nil
+}
 
-    fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+// Commit flushes the file to disk and renames it into place, syncing the
+// directory so the rename survives a crash too
+func (f *atomicFile) Commit() error {
+    if err := f.Sync(); err != nil {
+        f.Abort()
+        return err
+    }
+    if err := f.Close(); err != nil {
+        os.Remove(f.Name())
+        return err
+    }
+    if err := os.Rename(f.Name(), f.path); err != nil {
+        os.Remove(f.Name())
+        return err
+    }
+    return syncDir(filepath.Dir(f.path))
+}
 
-    return os.Create(fullPathWithRoot)
+// Abort discards the file, leaving the destination untouched
+func (f *atomicFile) Abort() {
+    f.Close()
+    os.Remove(f.Name())
 }
 
-// writeStream handles the actual file writing
+// writeFileAtomic replaces the file at path in one step
+func writeFileAtomic(path string, b []byte) error {
+    f, err := createAtomic(path)
+    if err != nil {
+        return err
+    }
+    if _, err := f.Write(b); err != nil {
+        f.Abort()
+        return err
+    }
+    return f.Commit()
+}
+
+// syncDir flushes a directory's entries to disk. Windows can't open
+// directories for syncing and persists renames without it.
+func syncDir(dir string) error {
+    if runtime.GOOS == "windows" {
+        return nil
+    }
+    d, err := os.Open(dir)
+    if err != nil {
+        return err
+    }
+    defer d.Close()
+    return d.Sync()
+}
+
+// writeStream handles the actual file writing, storing the chunks it doesn't
+// hold yet and then the manifest
 func (s *Store) writeStream(id string, key string, r io.Reader) (int64, error) {
-    f, err := s.openFileForWriting(id, key)
+    m, old, written, err := s.putStream(id, key, r)
     if err != nil {
+        s.collectUnused(written)
         return 0, err
     }
-    return io.Copy(f, r)
+    s.collectReplaced(old)
+
+    return m.Size, nil
+}
+
+// putStream chunks r into the store and writes its manifest, returning the
+// new manifest, the one it replaced and the chunks it stored. A failed
+// write still returns the chunks stored, for the caller to collect.
+func (s *Store) putStream(id string, key string, r io.Reader) (*Manifest, *Manifest, []ChunkRef, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+
+    m := &Manifest{Chunks: []ChunkRef{}, Created: time.Now().UnixNano()}
+    written := []ChunkRef{}
+    c := newChunker(r)
+    for {
+        b, err := c.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, nil, written, err
+        }
+
+        ref, created, err := s.putChunk(b)
+        if err != nil {
+            return nil, nil, written, err
+        }
+        if created {
+            written = append(written, ref)
+        }
+        m.Chunks = append(m.Chunks, ref)
+        m.Size += ref.Size
+    }
+
+    old, _ := s.readManifest(id, key)
+    return m, old, written, s.writeManifest(id, key, m)
 }
 
 // Read retrieves a file by ID and key
@@ -159,20 +616,41 @@ func (s *Store) Read(id string, key string) (int64, io.Reader, error) {
     return s.readStream(id, key)
 }
 
-// readStream handles the actual file reading
+// readStream handles the actual file reading, chunks are loaded as the
+// returned reader reaches them
 func (s *Store) readStream(id string, key string) (int64, io.ReadCloser, error) {
-    pathKey := s.PathTransformFunc(key)
-    fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
-
-    file, err := os.Open(fullPathWithRoot)
+    m, err := s.readManifest(id, key)
     if err != nil {
         return 0, nil, err
     }
 
-    fi, err := file.Stat()
-    if err != nil {
-        return 0, nil, err
+    return m.Size, &chunkReader{store: s, chunks: m.Chunks}, nil
+}
+
+// chunkReader reads a file by concatenating its chunks
+type chunkReader struct {
+    store  *Store
+    chunks []ChunkRef    // Chunks not loaded yet
+    buf    *bytes.Reader // Current chunk
+}
+
+func (cr *chunkReader) Read(b []byte) (int, error) {
+    for cr.buf == nil || cr.buf.Len() == 0 {
+        if len(cr.chunks) == 0 {
+            return 0, io.EOF
+        }
+        data, err := cr.store.ReadChunk(cr.chunks[0].Hash)
+        if err != nil {
+            return 0, err
+        }
+        cr.chunks = cr.chunks[1:]
+        cr.buf = bytes.NewReader(data)
     }
+    return cr.buf.Read(b)
+}
 
-    return fi.Size(), file, nil
+// Close releases the current chunk
+func (cr *chunkReader) Close() error {
+    cr.chunks, cr.buf = nil, nil
+    return nil
 }
\ No newline at end of file
@@ -2,16 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func TestPathTransformFunc(t *testing.T) {
 	key := "anythingFile"
-	pathKey := CASPathTransformFunc(key)
-	expectedFilename := "6804429f74181a63c50c3d81d733a12f14a353ff"
-	expectedPathName := "68044/29f74/181a6/3c50c/3d81d/733a1/2f14a/353ff"
+	pathKey := LegacyPathTransformFunc(key)
+	expectedFilename := "ac406a65c5663b369aa32c8934338deb92fbcda9"
+	expectedPathName := "ac406/a65c5/663b3/69aa3/2c893/4338d/eb92f/bcda9"
 	if pathKey.PathName != expectedPathName {
 		t.Errorf("have %s want %s", pathKey.PathName, expectedPathName)
 	}
@@ -21,6 +30,29 @@ func TestPathTransformFunc(t *testing.T) {
 	}
 }
 
+func TestCASPathTransformFunc(t *testing.T) {
+	key := "anythingFile"
+	for _, hash := range []HashFunc{SHA256Hash, BLAKE3Hash} {
+		sum := hash([]byte(key))
+		if len(sum) != 64 {
+			t.Fatalf("have %d hex characters want 64", len(sum))
+		}
+
+		pathKey := NewCASPathTransformFunc(hash, 3, 4)(key)
+		expectedPathName := sum[0:4] + "/" + sum[4:8] + "/" + sum[8:12]
+		if pathKey.PathName != expectedPathName || pathKey.Filename != sum {
+			t.Errorf("have %s want %s/%s", pathKey.FullPath(), expectedPathName, sum)
+		}
+	}
+
+	if SHA256Hash([]byte(key)) == BLAKE3Hash([]byte(key)) {
+		t.Error("hash functions agree")
+	}
+	if pathKey := NewCASPathTransformFunc(SHA256Hash, 0, 2)(key); pathKey.FullPath() != pathKey.Filename {
+		t.Errorf("have %s without fan-out want the bare filename", pathKey.FullPath())
+	}
+}
+
 func TestStore(t *testing.T) {
 	s := newStore()
 	id := generateID()
@@ -58,6 +90,281 @@ func TestStore(t *testing.T) {
 	}
 }
 
+func TestStoreWriteContextCancelled(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	defer teardown(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := s.WriteContext(ctx, id, "cancelled", bytes.NewReader([]byte("some jpg bytes"))); err != context.Canceled {
+		t.Errorf("have %v want %v", err, context.Canceled)
+	}
+
+	if ok := s.Has(id, "cancelled"); ok {
+		t.Errorf("expected no partial file after cancellation")
+	}
+}
+
+func TestStoreDedup(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	defer teardown(t, s)
+
+	a := make([]byte, 2<<20)
+	rand.New(rand.NewSource(1)).Read(a)
+	b := append(append([]byte(nil), a[:1<<20]...), "a small edit"...)
+	b = append(b, a[1<<20:]...)
+
+	if _, err := s.Write(id, "a", bytes.NewReader(a)); err != nil {
+		t.Fatal(err)
+	}
+	onlyA := countChunks(t, s)
+	if _, err := s.Write(id, "b", bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The near-identical file only adds the chunks around the edit
+	if added := countChunks(t, s) - onlyA; added > 2 {
+		t.Errorf("have %d new chunks for a one line edit want at most 2", added)
+	}
+
+	_, r, err := s.Read(id, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, _ := ioutil.ReadAll(r); !bytes.Equal(have, b) {
+		t.Error("read back different content")
+	}
+
+	// Deleting a file keeps the chunks the other one still uses
+	if err := s.Delete(id, "a"); err != nil {
+		t.Fatal(err)
+	}
+	_, r, err = s.Read(id, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, _ := ioutil.ReadAll(r); !bytes.Equal(have, b) {
+		t.Error("read back different content after deleting a")
+	}
+
+	if err := s.Delete(id, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countChunks(t, s); n != 0 {
+		t.Errorf("have %d chunks left want 0", n)
+	}
+}
+
+func TestStoreReadCorrupted(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	defer teardown(t, s)
+
+	if _, err := s.Write(id, "photo", bytes.NewReader([]byte("some jpg bytes"))); err != nil {
+		t.Fatal(err)
+	}
+	m, err := s.ReadManifest(id, "photo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := m.Chunks[0].Hash
+
+	// Flip a bit on disk
+	b, _ := os.ReadFile(s.chunkPath(hash))
+	b[0] ^= 1
+	if err := os.WriteFile(s.chunkPath(hash), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, r, err := s.Read(id, "photo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(r)
+	var corrupted *CorruptedError
+	if !errors.Is(err, ErrCorrupted) || !errors.As(err, &corrupted) || corrupted.Hash != hash {
+		t.Errorf("have %v want corrupted chunk %s", err, hash)
+	}
+
+	// The bad chunk is dropped so the next write of it stores it again
+	if s.hasChunk(hash) {
+		t.Error("corrupted chunk kept")
+	}
+}
+
+func TestStoreDeleteKeepsNeighbours(t *testing.T) {
+	for name, transform := range map[string]PathTransformFunc{
+		"cas":    CASPathTransformFunc,
+		"narrow": NewCASPathTransformFunc(SHA1Hash, 2, 1), // Collides on a single character
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: transform})
+			id := generateID()
+
+			// Find keys sharing the first directory, and one sharing all of them
+			target := "target"
+			sameFirst, sameDir := "", ""
+			for i := 0; len(sameFirst) == 0 || len(sameDir) == 0; i++ {
+				key := fmt.Sprintf("neighbour_%d", i)
+				switch pathKey := transform(key); {
+				case pathKey.PathName == transform(target).PathName:
+					sameDir = key
+				case pathKey.FirstPathName() == transform(target).FirstPathName():
+					sameFirst = key
+				}
+			}
+
+			for _, key := range []string{target, sameFirst, sameDir} {
+				if _, err := s.Write(id, key, bytes.NewReader([]byte(key))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Delete(id, target); err != nil {
+				t.Fatal(err)
+			}
+
+			if s.Has(id, target) {
+				t.Error("deleted file still present")
+			}
+			for _, key := range []string{sameFirst, sameDir} {
+				_, r, err := s.Read(id, key)
+				if err != nil {
+					t.Fatalf("neighbour %s lost: %s", key, err)
+				}
+				if b, _ := ioutil.ReadAll(r); string(b) != key {
+					t.Errorf("have %q want %q", b, key)
+				}
+			}
+
+			// Deleting the rest leaves no empty directories behind
+			for _, key := range []string{sameFirst, sameDir} {
+				if err := s.Delete(id, key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			entries, err := os.ReadDir(s.Root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if e.IsDir() {
+					t.Errorf("directory %s left in the root", e.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestStoreWriteAtomic(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	id := generateID()
+
+	if _, err := s.Write(id, "report.pdf", bytes.NewReader([]byte("first draft"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// A transfer failing halfway keeps the old contents
+	failing := io.MultiReader(bytes.NewReader(make([]byte, 3*maxChunkSize)), iotest.ErrReader(io.ErrUnexpectedEOF))
+	if _, err := s.Write(id, "report.pdf", failing); err != io.ErrUnexpectedEOF {
+		t.Errorf("have %v want %v", err, io.ErrUnexpectedEOF)
+	}
+	_, r, err := s.Read(id, "report.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(r); string(b) != "first draft" {
+		t.Errorf("have %q want the old contents", b)
+	}
+
+	// Nor is anything half-written left behind
+	path := s.manifestPath(id, "report.pdf")
+	f, err := createAtomic(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("partial"))
+	if m, err := s.ReadManifest(id, "report.pdf"); err != nil || m.Size != int64(len("first draft")) {
+		t.Errorf("unfinished write visible: %v", err)
+	}
+	f.Abort()
+
+	err = filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && strings.Contains(d.Name(), ".tmp") {
+			t.Errorf("temporary file %s left behind", path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreFailedWriteLeavesNoChunks(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	id := generateID()
+
+	data := make([]byte, 2<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	if _, err := s.Write(id, "kept", bytes.NewReader(data[:1<<20])); err != nil {
+		t.Fatal(err)
+	}
+	kept := countChunks(t, s)
+
+	// A stream breaking off, after chunks shared with the kept file
+	failing := io.MultiReader(bytes.NewReader(data), iotest.ErrReader(io.ErrUnexpectedEOF))
+	if _, err := s.Write(id, "streamed", failing); err != io.ErrUnexpectedEOF {
+		t.Errorf("have %v want %v", err, io.ErrUnexpectedEOF)
+	}
+
+	// A transfer breaking off after its first chunk
+	other := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	if _, err := other.Write(id, "fetched", bytes.NewReader(data[1<<20:])); err != nil {
+		t.Fatal(err)
+	}
+	m, err := other.ReadManifest(id, "fetched")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := other.ReadChunk(m.Chunks[0].Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.WriteManifest(id, "fetched", m, func([]int) (io.Reader, error) {
+		return io.MultiReader(bytes.NewReader(first), iotest.ErrReader(io.ErrUnexpectedEOF)), nil
+	})
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("have %v want %v", err, io.ErrUnexpectedEOF)
+	}
+
+	if n := countChunks(t, s); n != kept {
+		t.Errorf("have %d chunks want the %d of the kept file", n, kept)
+	}
+	_, r, err := s.Read(id, "kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(r); !bytes.Equal(b, data[:1<<20]) {
+		t.Error("kept file lost chunks")
+	}
+}
+
+func countChunks(t *testing.T, s *Store) int {
+	n := 0
+	err := filepath.Walk(filepath.Join(s.Root, chunkFolderName), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			n++
+		}
+		return err
+	})
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return n
+}
+
 func newStore() *Store {
 	opts := StoreOpts{
 		PathTransformFunc: CASPathTransformFunc,
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/utkarshgupta2804/p2p-filestorage/p2p"
+)
+
+// tombstoneFileName is the file under the storage root keeping tombstones
+const tombstoneFileName = "tombstones.json"
+
+var (
+	// ErrDeleted is returned for files deleted from the network
+	ErrDeleted = errors.New("file was deleted")
+	// ErrNoIdentity is returned when deleting without a node identity to
+	// sign the deletion with
+	ErrNoIdentity = errors.New("deleting from the network requires a node identity")
+)
+
+// MessageDeleteFile removes a file from the network. It is signed by the node
+// that stored the file, so nobody else can delete it.
+type MessageDeleteFile struct {
+	ID        string // Node that stored the file
+	Key       string // Network key of the file
+	Deleted   int64  // Unix nanoseconds at deletion, copies stored later survive
+	Signature []byte // Owner's signature of the fields above
+}
+
+// MessageDeleteFileResponse answers a MessageDeleteFile
+type MessageDeleteFileResponse struct {
+	Deleted bool // Whether the deletion was accepted
+}
+
+// signedBytes returns what the owner signs
+func (m MessageDeleteFile) signedBytes() []byte {
+	return []byte(fmt.Sprintf("delete\x00%s\x00%s\x00%d", m.ID, m.Key, m.Deleted))
+}
+
+// verify reports whether the deletion was signed by the file's owner
+func (m MessageDeleteFile) verify() bool {
+	return p2p.VerifyID(m.ID, m.signedBytes(), m.Signature)
+}
+
+// tombstones remembers the files deleted from the network, so a peer that
+// missed a deletion is told about it when it offers the file again instead
+// of bringing it back
+type tombstones struct {
+	path string // Persisted here, empty to keep them in memory
+
+	lock    sync.Mutex
+	deleted map[string]MessageDeleteFile // Signed deletions by owner ID and key
+}
+
+// newTombstones creates an empty set of tombstones persisted at path
+func newTombstones(path string) *tombstones {
+	return &tombstones{path: path, deleted: make(map[string]MessageDeleteFile)}
+}
+
+// loadTombstones reads the tombstones persisted at path
+func loadTombstones(path string) (*tombstones, error) {
+	t := newTombstones(path)
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	list := []MessageDeleteFile{}
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("tombstones %s: %w", path, err)
+	}
+	for _, msg := range list {
+		t.deleted[tombstoneID(msg.ID, msg.Key)] = msg
+	}
+	return t, nil
+}
+
+// tombstoneID identifies the file a tombstone is for
+func tombstoneID(id string, key string) string {
+	return id + "/" + key
+}
+
+// add records a deletion unless a later one is known already
+func (t *tombstones) add(msg MessageDeleteFile) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if old, ok := t.deleted[tombstoneID(msg.ID, msg.Key)]; ok && old.Deleted >= msg.Deleted {
+		return nil
+	}
+	t.deleted[tombstoneID(msg.ID, msg.Key)] = msg
+	return t.save()
+}
+
+// remove forgets the deletion of a file stored again since
+func (t *tombstones) remove(id string, key string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, ok := t.deleted[tombstoneID(id, key)]; !ok {
+		return nil
+	}
+	delete(t.deleted, tombstoneID(id, key))
+	return t.save()
+}
+
+// covers returns the deletion of a file if it happened after the copy
+// created at the given time was stored
+func (t *tombstones) covers(id string, key string, created int64) (MessageDeleteFile, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	msg, ok := t.deleted[tombstoneID(id, key)]
+	return msg, ok && msg.Deleted >= created
+}
+
+// save persists the tombstones, must be called with the lock held
+func (t *tombstones) save() error {
+	if len(t.path) == 0 {
+		return nil
+	}
+
+	list := make([]MessageDeleteFile, 0, len(t.deleted))
+	for _, msg := range t.deleted {
+		list = append(list, msg)
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(t.path, b)
+}
+
+// DeleteContext removes a file stored under key from this node and from the
+// nodes holding replicas. The deletion is signed and remembered, nodes that
+// can't be reached now learn about it when they offer the file again.
+func (s *FileServer) DeleteContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.Identity == nil {
+		return ErrNoIdentity
+	}
+
+	msg := MessageDeleteFile{ID: s.ID, Key: s.hashKey(key), Deleted: time.Now().UnixNano()}
+	msg.Signature = s.Identity.Sign(msg.signedBytes())
+
+	// Remember the deletion first, so it isn't lost if we stop halfway
+	if err := s.tombstones.add(msg); err != nil {
+		return err
+	}
+	if err := s.store.Delete(s.ID, key); err != nil {
+		return err
+	}
+	s.untrack(holding{ID: s.ID, Key: msg.Key})
+
+	_, holders := s.lookup(ctx, keyNodeID(msg.Key), &MessageFindValue{ID: s.ID, Key: msg.Key})
+	targets := map[string]bool{}
+	for _, c := range holders {
+		targets[c.ID] = true
+	}
+	for _, id := range s.ring.owners(msg.Key, s.ReplicationFactor, s.ID) {
+		targets[id] = true
+	}
+	delete(targets, s.ID)
+
+	for id := range targets {
+		if err := s.sendDelete(ctx, id, msg); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("[%s] delete of (%s) on %s failed, it learns about it later: %s", s.Transport.Addr(), msg.Key, id, err)
+		}
+	}
+
+	return nil
+}
+
+// sendDelete asks the node with the given ID to delete its copy of a file
+func (s *FileServer) sendDelete(ctx context.Context, id string, msg MessageDeleteFile) error {
+	c, ok := s.rt.contact(id)
+	if !ok {
+		return fmt.Errorf("no contact for node %s", id)
+	}
+
+	reply, err := s.callContact(ctx, c, msg)
+	if err != nil {
+		return err
+	}
+	if res, ok := reply.Payload.(MessageDeleteFileResponse); !ok || !res.Deleted {
+		return fmt.Errorf("deletion refused")
+	}
+	return nil
+}
+
+// applyDelete records a deletion signed by a file's owner and removes the
+// local copy if it predates it
+func (s *FileServer) applyDelete(msg MessageDeleteFile) error {
+	if !msg.verify() {
+		return fmt.Errorf("deletion of (%s) not signed by its owner %s", msg.Key, msg.ID)
+	}
+	if err := s.tombstones.add(msg); err != nil {
+		return err
+	}
+
+	m, err := s.store.ReadManifest(msg.ID, msg.Key)
+	if err != nil || m.Created > msg.Deleted {
+		return nil // Nothing held, or stored again since
+	}
+	if err := s.store.Delete(msg.ID, msg.Key); err != nil {
+		return err
+	}
+	s.untrack(holding{ID: msg.ID, Key: msg.Key})
+
+	fmt.Printf("[%s] deleted (%s) on behalf of %s\n", s.Transport.Addr(), msg.Key, msg.ID)
+
+	return nil
+}
+
+// handleMessageDeleteFile processes deletions sent by a file's owner
+func (s *FileServer) handleMessageDeleteFile(from string, id uint64, msg MessageDeleteFile) error {
+	if err := s.applyDelete(msg); err != nil {
+		s.respond(from, id, MessageDeleteFileResponse{Deleted: false})
+		return err
+	}
+	return s.respond(from, id, MessageDeleteFileResponse{Deleted: true})
+}
+
+// tombstonePath returns where the tombstones of a storage root are kept
+func tombstonePath(root string) string {
+	return filepath.Join(root, tombstoneFileName)
+}
+
+func init() {
+	gob.Register(MessageDeleteFile{})
+	gob.Register(MessageDeleteFileResponse{})
+}
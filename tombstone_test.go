@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/utkarshgupta2804/p2p-filestorage/p2p"
+)
+
+func TestDeleteLeavesTombstone(t *testing.T) {
+	identity, err := p2p.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := NewFileServer(FileServerOpts{
+		Identity:          identity,
+		StorageRoot:       filepath.Join(t.TempDir(), "owner"),
+		PathTransformFunc: CASPathTransformFunc,
+		Transport:         stubTransport{},
+	})
+	replica := NewFileServer(FileServerOpts{
+		StorageRoot:       filepath.Join(t.TempDir(), "replica"),
+		PathTransformFunc: CASPathTransformFunc,
+		Transport:         stubTransport{},
+	})
+
+	if err := owner.Store("doomed.txt", bytes.NewReader([]byte("short lived"))); err != nil {
+		t.Fatal(err)
+	}
+	key := owner.hashKey("doomed.txt")
+	if _, err := replica.store.Write(owner.ID, key, bytes.NewReader([]byte("ciphertext"))); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := replica.store.ReadManifest(owner.ID, key)
+
+	if err := owner.Delete("doomed.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := owner.Get("doomed.txt"); err != ErrDeleted {
+		t.Errorf("have %v want %v", err, ErrDeleted)
+	}
+	deletion, ok := owner.tombstones.covers(owner.ID, key, 0)
+	if !ok {
+		t.Fatal("owner kept no tombstone")
+	}
+
+	// Only the owner can delete its files
+	forged := deletion
+	forged.Deleted = time.Now().UnixNano()
+	if err := replica.applyDelete(forged); err == nil {
+		t.Error("deletion with a forged signature accepted")
+	}
+	if !replica.store.Has(owner.ID, key) {
+		t.Fatal("forged deletion removed the replica")
+	}
+
+	if err := replica.applyDelete(deletion); err != nil {
+		t.Fatal(err)
+	}
+	if replica.store.Has(owner.ID, key) {
+		t.Error("replica kept a deleted file")
+	}
+
+	// The tombstone outlives a restart and turns away the old copy, but not
+	// one stored after the deletion
+	restarted, err := loadTombstones(tombstonePath(replica.store.Root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restarted.covers(owner.ID, key, stored.Created); !ok {
+		t.Error("copy stored before the deletion not covered after a restart")
+	}
+	if _, ok := restarted.covers(owner.ID, key, time.Now().UnixNano()); ok {
+		t.Error("copy stored after the deletion covered")
+	}
+
+	// Storing the file again brings it back
+	if err := owner.Store("doomed.txt", bytes.NewReader([]byte("second life"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := owner.GetContext(context.Background(), "doomed.txt"); err != nil {
+		t.Errorf("have %v after storing again want the file", err)
+	}
+
+	if err := replica.Delete("anything"); err != ErrNoIdentity {
+		t.Errorf("have %v want %v", err, ErrNoIdentity)
+	}
+}